@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+
+	_ "github.com/lib/pq"
+
+	"server/config"
+	"server/payments"
+	"server/validators"
+	"server/vault"
+)
+
+type cardRow struct {
+	id         int
+	userID     int
+	number     string
+	sealed     []byte
+	keyVersion int
+}
+
+func main() {
+	cfg := config.LoadConfig()
+	kr, err := vault.NewKeyring(cfg.CardKeys, cfg.CardKeyVersion)
+	if err != nil {
+		log.Fatalf("Не удалось загрузить ключи шифрования карт (CARD_KEYS): %v", err)
+	}
+	if len(cfg.CardFingerprintKey) == 0 {
+		log.Fatal("CARD_FINGERPRINT_KEY is not set in environment")
+	}
+
+	db, err := sql.Open("postgres", cfg.DBConnStr)
+	if err != nil {
+		log.Fatalf("Не удалось открыть подключение к БД: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Fatalf("Не удалось начать транзакцию: %v", err)
+	}
+	defer tx.Rollback()
+
+	var hasPlaintext bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM information_schema.columns
+			WHERE table_name = 'payment_cards' AND column_name = 'card_number'
+		)
+	`).Scan(&hasPlaintext); err != nil {
+		log.Fatalf("Ошибка чтения схемы: %v", err)
+	}
+
+	encrypted := 0
+	if hasPlaintext {
+		cards, err := loadCards(tx, `
+			SELECT card_id, user_id, card_number, NULL::bytea, 0
+			FROM payment_cards WHERE card_number IS NOT NULL
+			FOR UPDATE
+		`)
+		if err != nil {
+			log.Fatalf("Ошибка чтения карт: %v", err)
+		}
+		for _, c := range cards {
+			number := strings.ReplaceAll(c.number, " ", "")
+			sealed, version, err := payments.SealCard(kr, c.userID, number)
+			if err != nil {
+				log.Fatalf("Карта %d: %v", c.id, err)
+			}
+			if _, err := tx.Exec(`
+				UPDATE payment_cards
+				SET card_number_enc = $1, key_version = $2, last4 = $3, brand = $4, card_number = NULL
+				WHERE card_id = $5
+			`, sealed, version, number[len(number)-4:], validators.CardBrand(number), c.id); err != nil {
+				log.Fatalf("Карта %d: %v", c.id, err)
+			}
+			encrypted++
+		}
+	}
+
+	cards, err := loadCards(tx, `
+		SELECT card_id, user_id, '', card_number_enc, key_version
+		FROM payment_cards
+		WHERE card_number_enc IS NOT NULL AND key_version <> $1
+		FOR UPDATE
+	`, kr.Active())
+	if err != nil {
+		log.Fatalf("Ошибка чтения карт: %v", err)
+	}
+	for _, c := range cards {
+		number, err := payments.OpenCard(kr, c.userID, c.sealed, c.keyVersion)
+		if err != nil {
+			log.Fatalf("Карта %d (ключ %d): %v", c.id, c.keyVersion, err)
+		}
+		sealed, version, err := payments.SealCard(kr, c.userID, number)
+		if err != nil {
+			log.Fatalf("Карта %d: %v", c.id, err)
+		}
+		if _, err := tx.Exec(`
+			UPDATE payment_cards SET card_number_enc = $1, key_version = $2
+			WHERE card_id = $3
+		`, sealed, version, c.id); err != nil {
+			log.Fatalf("Карта %d: %v", c.id, err)
+		}
+	}
+
+	// fingerprint appears only in 011, so the run between 009 and 010 skips
+	// the backfill and the tool is run once more after 011.
+	var hasFingerprint bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM information_schema.columns
+			WHERE table_name = 'payment_cards' AND column_name = 'fingerprint'
+		)
+	`).Scan(&hasFingerprint); err != nil {
+		log.Fatalf("Ошибка чтения схемы: %v", err)
+	}
+	fingerprinted := 0
+	if hasFingerprint {
+		fingerprinted = backfillFingerprints(tx, kr, cfg.CardFingerprintKey)
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Fatalf("Не удалось зафиксировать транзакцию: %v", err)
+	}
+	log.Printf("Зашифровано карт: %d, перешифровано ключом %d: %d, заполнено fingerprint: %d",
+		encrypted, kr.Active(), len(cards), fingerprinted)
+}
+
+func backfillFingerprints(tx *sql.Tx, kr *vault.Keyring, fingerprintKey []byte) int {
+	missing, err := loadCards(tx, `
+		SELECT card_id, user_id, '', card_number_enc, key_version
+		FROM payment_cards
+		WHERE card_number_enc IS NOT NULL AND fingerprint IS NULL
+		ORDER BY card_id
+		FOR UPDATE
+	`)
+	if err != nil {
+		log.Fatalf("Ошибка чтения карт: %v", err)
+	}
+	fingerprinted := 0
+	for _, c := range missing {
+		number, err := payments.OpenCard(kr, c.userID, c.sealed, c.keyVersion)
+		if err != nil {
+			log.Fatalf("Карта %d (ключ %d): %v", c.id, c.keyVersion, err)
+		}
+		res, err := tx.Exec(`
+			UPDATE payment_cards SET fingerprint = $1
+			WHERE card_id = $2 AND NOT EXISTS (
+				SELECT 1 FROM payment_cards WHERE user_id = $3 AND fingerprint = $1
+			)
+		`, payments.CardFingerprint(fingerprintKey, number), c.id, c.userID)
+		if err != nil {
+			log.Fatalf("Карта %d: %v", c.id, err)
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			log.Printf("Карта %d пользователя %d уже сохранена под другим id, fingerprint не заполнен", c.id, c.userID)
+			continue
+		}
+		fingerprinted++
+	}
+	return fingerprinted
+}
+
+func loadCards(tx *sql.Tx, query string, args ...interface{}) ([]cardRow, error) {
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cards []cardRow
+	for rows.Next() {
+		var c cardRow
+		if err := rows.Scan(&c.id, &c.userID, &c.number, &c.sealed, &c.keyVersion); err != nil {
+			return nil, err
+		}
+		cards = append(cards, c)
+	}
+	return cards, rows.Err()
+}
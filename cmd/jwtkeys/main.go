@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	dir := flag.String("dir", "keys", "каталог ключей (JWT_KEYS_DIR)")
+	kid := flag.String("kid", "", "идентификатор нового ключа")
+	alg := flag.String("alg", "EdDSA", "алгоритм: EdDSA или RS256")
+	flag.Parse()
+	if *kid == "" {
+		log.Fatal("Укажите -kid")
+	}
+
+	var priv interface{}
+	var err error
+	switch *alg {
+	case "EdDSA":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	case "RS256":
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	default:
+		log.Fatalf("Неизвестный алгоритм %q", *alg)
+	}
+	if err != nil {
+		log.Fatalf("Не удалось сгенерировать ключ: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		log.Fatalf("Не удалось сериализовать ключ: %v", err)
+	}
+
+	if err := os.MkdirAll(*dir, 0o700); err != nil {
+		log.Fatalf("Не удалось создать каталог: %v", err)
+	}
+	path := filepath.Join(*dir, *kid+".pem")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		log.Fatalf("Не удалось создать файл ключа: %v", err)
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "PRIVATE KEY", Bytes: der}); err != nil {
+		log.Fatalf("Не удалось записать ключ: %v", err)
+	}
+	log.Printf("Ключ %s записан в %s. Чтобы подписывать им токены, задайте JWT_ACTIVE_KID=%s;", *kid, path, *kid)
+	log.Printf("прежние ключи оставьте в каталоге, пока не истекут выданные ими токены")
+}
@@ -1,20 +1,73 @@
 package config
 
 import (
+	"log"
 	"os"
+	"strconv"
+	"time"
 )
 
 type Config struct {
-	DBConnStr  string
-	JWTSecret  []byte
-	ServerPort string
+	DBConnStr          string
+	JWTKeysDir         string
+	JWTActiveKID       string
+	ServerPort         string
+	AccessTokenTTL     time.Duration
+	RefreshTokenTTL    time.Duration
+	IdempotencyTTL     time.Duration
+	PaymentTTL         time.Duration
+	CardKeys           string
+	CardKeyVersion     int
+	CardFingerprintKey []byte
+	UserTokenKey       []byte
+	AppBaseURL         string
+	MailDriver         string
+	MailFrom           string
+	MailDir            string
+	SMTPAddr           string
+	SMTPUser           string
+	SMTPPassword       string
+	LoginGuardStore    string
+	LoginLockoutAfter  int
+	LoginLockoutFor    time.Duration
+	IPLockoutAfter     int
+	TrustedProxies     string
+	TOTPKeys           string
+	TOTPKeyVersion     int
+	TOTPIssuer         string
+	RecoveryCodeKey    []byte
 }
 
 func LoadConfig() *Config {
 	return &Config{
-		DBConnStr:  getEnvOrDefault("DB_CONN", "host=localhost port=5432 user=postgres password=2006Hjvfy! dbname=playboxdb sslmode=disable"),
-		JWTSecret:  []byte(getEnvOrDefault("JWT_SECRET", "")),
-		ServerPort: getEnvOrDefault("PORT", "8080"),
+		DBConnStr:          getEnvOrDefault("DB_CONN", "host=localhost port=5432 user=postgres password=2006Hjvfy! dbname=playboxdb sslmode=disable"),
+		JWTKeysDir:         getEnvOrDefault("JWT_KEYS_DIR", "keys"),
+		JWTActiveKID:       getEnvOrDefault("JWT_ACTIVE_KID", ""),
+		ServerPort:         getEnvOrDefault("PORT", "8080"),
+		AccessTokenTTL:     getDurationOrDefault("ACCESS_TOKEN_TTL", 15*time.Minute),
+		RefreshTokenTTL:    getDurationOrDefault("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+		IdempotencyTTL:     getDurationOrDefault("IDEMPOTENCY_TTL", 24*time.Hour),
+		PaymentTTL:         getDurationOrDefault("PAYMENT_TTL", 30*time.Minute),
+		CardKeys:           getEnvOrDefault("CARD_KEYS", ""),
+		CardKeyVersion:     getIntOrDefault("CARD_KEY_VERSION", 1),
+		CardFingerprintKey: []byte(getEnvOrDefault("CARD_FINGERPRINT_KEY", "")),
+		UserTokenKey:       []byte(getEnvOrDefault("USER_TOKEN_KEY", "")),
+		AppBaseURL:         getEnvOrDefault("APP_BASE_URL", "http://localhost:8080"),
+		MailDriver:         getEnvOrDefault("MAIL_DRIVER", ""),
+		MailFrom:           getEnvOrDefault("MAIL_FROM", "PlayBox <no-reply@playbox.local>"),
+		MailDir:            getEnvOrDefault("MAIL_DIR", ""),
+		SMTPAddr:           getEnvOrDefault("SMTP_ADDR", ""),
+		SMTPUser:           getEnvOrDefault("SMTP_USER", ""),
+		SMTPPassword:       getEnvOrDefault("SMTP_PASSWORD", ""),
+		LoginGuardStore:    getEnvOrDefault("LOGIN_GUARD_STORE", "postgres"),
+		LoginLockoutAfter:  getIntOrDefault("LOGIN_LOCKOUT_AFTER", 10),
+		LoginLockoutFor:    getDurationOrDefault("LOGIN_LOCKOUT_FOR", 30*time.Minute),
+		IPLockoutAfter:     getIntOrDefault("LOGIN_IP_LOCKOUT_AFTER", 50),
+		TrustedProxies:     getEnvOrDefault("TRUSTED_PROXIES", ""),
+		TOTPKeys:           getEnvOrDefault("TOTP_KEYS", ""),
+		TOTPKeyVersion:     getIntOrDefault("TOTP_KEY_VERSION", 1),
+		TOTPIssuer:         getEnvOrDefault("TOTP_ISSUER", "PlayBox"),
+		RecoveryCodeKey:    []byte(getEnvOrDefault("RECOVERY_CODE_KEY", "")),
 	}
 }
 
@@ -25,3 +78,27 @@ func getEnvOrDefault(key, def string) string {
 	}
 	return val
 }
+
+func getDurationOrDefault(key string, def time.Duration) time.Duration {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	d, err := time.ParseDuration(val)
+	if err != nil {
+		log.Fatalf("Неверное значение %s: %v", key, err)
+	}
+	return d
+}
+
+func getIntOrDefault(key string, def int) int {
+	val := os.Getenv(key)
+	if val == "" {
+		return def
+	}
+	n, err := strconv.Atoi(val)
+	if err != nil {
+		log.Fatalf("Неверное значение %s: %v", key, err)
+	}
+	return n
+}
@@ -4,9 +4,8 @@ go 1.23.0
 
 toolchain go1.23.9
 
-require github.com/lib/pq v1.10.9
-
 require (
-	github.com/golang-jwt/jwt/v5 v5.2.2 // indirect
-	golang.org/x/crypto v0.38.0 // indirect
+	github.com/golang-jwt/jwt/v5 v5.2.2
+	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.38.0
 )
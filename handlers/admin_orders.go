@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"server/models"
+	"server/orderstatus"
+	"server/payments"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+func AdminOrderHandler(db *sql.DB, gw payments.Gateway, getUserID func(*http.Request) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 3 || len(parts) > 4 || (len(parts) == 4 && parts[3] != "status") {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		id, err := strconv.Atoi(parts[2])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Bad order_id")
+			return
+		}
+		if len(parts) == 4 {
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+				return
+			}
+			changeOrderStatus(db, gw, w, r, id, getUserID(r))
+			return
+		}
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		writeOrderDetails(db, w, http.StatusOK, id, 0)
+	}
+}
+
+func changeOrderStatus(db *sql.DB, gw payments.Gateway, w http.ResponseWriter, r *http.Request, id, actorID int) {
+	var req models.OrderStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	if utf8.RuneCountInString(req.Comment) > 500 {
+		writeError(w, http.StatusBadRequest, "comment must be at most 500 characters")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	defer tx.Rollback()
+	_, err = orderstatus.Transition(tx, id, 0, req.Status, actorID, req.Comment)
+	if !writeTransitionError(w, err) {
+		return
+	}
+	if req.Status == orderstatus.Cancelled {
+		if err := payments.CloseForOrder(tx, id); err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	if req.Status == orderstatus.Cancelled {
+		payments.Refund(r.Context(), db, gw, id)
+	}
+	writeOrderDetails(db, w, http.StatusOK, id, 0)
+}
+
+func writeTransitionError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+	switch e := err.(type) {
+	case *orderstatus.TransitionError:
+		writeError(w, http.StatusConflict, e.Error())
+	default:
+		switch err {
+		case orderstatus.ErrOrderNotFound:
+			writeError(w, http.StatusNotFound, "Order not found")
+		case orderstatus.ErrUnknownStatus:
+			writeError(w, http.StatusBadRequest, "Unknown order status")
+		default:
+			writeError(w, http.StatusInternalServerError, "DB error")
+		}
+	}
+	return false
+}
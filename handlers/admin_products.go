@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"server/models"
+	"server/validators"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+func setProductCategories(tx *sql.Tx, productID int, categoryIDs []int) error {
+	if _, err := tx.Exec("DELETE FROM products_categories WHERE product_id = $1", productID); err != nil {
+		return err
+	}
+	if len(categoryIDs) == 0 {
+		return nil
+	}
+	_, err := tx.Exec(`
+		INSERT INTO products_categories (product_id, category_id)
+		SELECT $1, unnest($2::int[])
+	`, productID, pq.Array(categoryIDs))
+	return err
+}
+
+func categoriesExist(db *sql.DB, ids []int) (bool, error) {
+	if len(ids) == 0 {
+		return true, nil
+	}
+	var n int
+	err := db.QueryRow(
+		"SELECT COUNT(*) FROM categories WHERE category_id = ANY($1)", pq.Array(ids),
+	).Scan(&n)
+	return n == len(ids), err
+}
+
+func decodeProductRequest(db *sql.DB, w http.ResponseWriter, r *http.Request) (*models.ProductRequest, bool) {
+	var req models.ProductRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Неверный формат JSON", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := validators.ValidateProduct(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	ok, err := categoriesExist(db, req.CategoryIDs)
+	if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !ok {
+		http.Error(w, "Неизвестная категория в category_ids", http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+func writeProduct(db *sql.DB, w http.ResponseWriter, id, status int) {
+	p, err := loadProduct(db, id)
+	if err != nil {
+		http.Error(w, "Ошибка чтения из БД", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func AdminProductsHandler(db *sql.DB, onChange func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		req, ok := decodeProductRequest(db, w, r)
+		if !ok {
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		var id int
+		err = tx.QueryRow(`
+			INSERT INTO products
+				(name, price, color, width_cm, height_cm, weight_g, description, image_url, quantity_in_stock)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+			RETURNING product_id
+		`, req.Name, req.Price, req.Color, req.WidthCm, req.HeightCm, req.WeightG,
+			req.Description, req.ImageURL, req.QuantityInStock).Scan(&id)
+		if isUniqueViolation(err) {
+			http.Error(w, "Товар с таким названием уже существует", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		if err := setProductCategories(tx, id, req.CategoryIDs); err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		onChange()
+		writeProduct(db, w, id, http.StatusCreated)
+	}
+}
+
+func AdminProductHandler(db *sql.DB, onChange func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 3 || len(parts) > 4 || (len(parts) == 4 && parts[3] != "restock") {
+			http.Error(w, "Неверный путь", http.StatusNotFound)
+			return
+		}
+		id, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.Error(w, "ID должен быть числом", http.StatusBadRequest)
+			return
+		}
+		if len(parts) == 4 {
+			restockProduct(db, w, r, id)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			updateProduct(db, w, r, id, onChange)
+		case http.MethodDelete:
+			deleteProduct(db, w, id, onChange)
+		default:
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func updateProduct(db *sql.DB, w http.ResponseWriter, r *http.Request, id int, onChange func()) {
+	req, ok := decodeProductRequest(db, w, r)
+	if !ok {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`
+		UPDATE products
+		SET name = $1, price = $2, color = $3, width_cm = $4, height_cm = $5,
+		    weight_g = $6, description = $7, image_url = $8, quantity_in_stock = $9
+		WHERE product_id = $10 AND deleted_at IS NULL
+	`, req.Name, req.Price, req.Color, req.WidthCm, req.HeightCm, req.WeightG,
+		req.Description, req.ImageURL, req.QuantityInStock, id)
+	if isUniqueViolation(err) {
+		http.Error(w, "Товар с таким названием уже существует", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		http.Error(w, "Товар не найден", http.StatusNotFound)
+		return
+	}
+	if err := setProductCategories(tx, id, req.CategoryIDs); err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	onChange()
+	writeProduct(db, w, id, http.StatusOK)
+}
+
+func deleteProduct(db *sql.DB, w http.ResponseWriter, id int, onChange func()) {
+	res, err := db.Exec(`
+		UPDATE products SET deleted_at = now()
+		WHERE product_id = $1 AND deleted_at IS NULL
+	`, id)
+	if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		http.Error(w, "Товар не найден", http.StatusNotFound)
+		return
+	}
+	onChange()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func restockProduct(db *sql.DB, w http.ResponseWriter, r *http.Request, id int) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		return
+	}
+	var req models.RestockRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Неверный формат JSON", http.StatusBadRequest)
+		return
+	}
+	if req.Quantity <= 0 {
+		http.Error(w, "quantity must be positive", http.StatusBadRequest)
+		return
+	}
+	res, err := db.Exec(`
+		UPDATE products SET quantity_in_stock = quantity_in_stock + $1
+		WHERE product_id = $2 AND deleted_at IS NULL
+	`, req.Quantity, id)
+	if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		http.Error(w, "Товар не найден", http.StatusNotFound)
+		return
+	}
+	writeProduct(db, w, id, http.StatusOK)
+}
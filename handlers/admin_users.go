@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"server/loginguard"
+	"strconv"
+	"strings"
+)
+
+func AdminUserHandler(db *sql.DB, guard *loginguard.Guard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 4 || parts[3] != "unlock" {
+			http.Error(w, "Неверный путь", http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.Error(w, "ID должен быть числом", http.StatusBadRequest)
+			return
+		}
+		var email string
+		err = db.QueryRow("SELECT email FROM users WHERE user_id = $1", id).Scan(&email)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Пользователь не найден", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		if err := guard.Unlock(email); err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
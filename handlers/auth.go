@@ -3,17 +3,23 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"log"
+	"math"
 	"net/http"
+	"server/loginguard"
+	"server/mail"
+	"server/mfa"
 	"server/models"
+	"server/sessions"
+	"server/usertokens"
 	"server/validators"
-	"time"
+	"strconv"
 	"unicode/utf8"
 
-	"github.com/golang-jwt/jwt/v5"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func RegisterHandler(db *sql.DB) http.HandlerFunc {
+func RegisterHandler(db *sql.DB, tokens *usertokens.Issuer, mailer mail.Mailer, baseURL string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
@@ -59,21 +65,62 @@ func RegisterHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
 			return
 		}
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
 		var userID int
-		err = db.QueryRow(`
+		err = tx.QueryRow(`
 			INSERT INTO users (role_id, first_name, last_name, email, phone, password_hash)
-			VALUES (2, $1, $2, $3, $4, $5) RETURNING user_id
+			VALUES (2, $1, $2, $3, NULLIF($4, ''), $5) RETURNING user_id
 		`, creds.FirstName, creds.LastName, creds.Email, creds.Phone, string(hash)).Scan(&userID)
 		if err != nil {
 			http.Error(w, "Email или телефон уже заняты", http.StatusConflict)
 			return
 		}
+		token, err := tokens.Issue(tx, userID, usertokens.VerifyEmail, nil)
+		if err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		go sendTokenMail(mailer, baseURL, creds.Email, usertokens.VerifyEmail, token)
 		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(map[string]int{"user_id": userID})
 	}
 }
 
-func LoginHandler(db *sql.DB, jwtKey []byte) http.HandlerFunc {
+// reserveAttempt asks the guard for an attempt and answers 429 when the caller
+// has to wait. A true result means the attempt was reserved and counts as a
+// failure until the guard is told otherwise.
+func reserveAttempt(w http.ResponseWriter, guard *loginguard.Guard, email, ip string) bool {
+	wait, err := guard.Attempt(email, ip)
+	if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return false
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, "Слишком много попыток, попробуйте позже", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// releaseAttempt gives a reservation back when the request failed for a reason
+// that says nothing about the secret being guessed.
+func releaseAttempt(guard *loginguard.Guard, email, ip string) {
+	if err := guard.Release(email, ip); err != nil {
+		log.Printf("Не удалось вернуть попытку входа для %s: %v", email, err)
+	}
+}
+
+func LoginHandler(db *sql.DB, sm *sessions.Manager, guard *loginguard.Guard, mf *mfa.Manager) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
@@ -84,41 +131,63 @@ func LoginHandler(db *sql.DB, jwtKey []byte) http.HandlerFunc {
 			http.Error(w, "Неверный формат JSON", http.StatusBadRequest)
 			return
 		}
-		var storedHash string
+		ip := guard.ClientIP(r)
+		if !reserveAttempt(w, guard, creds.Email, ip) {
+			return
+		}
+		var storedHash, role string
 		var userID int
+		var verified bool
 		err := db.QueryRow(`
-			SELECT user_id, password_hash FROM users WHERE email = $1
-		`, creds.Email).Scan(&userID, &storedHash)
-		if err == sql.ErrNoRows {
+			SELECT u.user_id, u.password_hash, r.role_name, u.email_verified_at IS NOT NULL
+			FROM users u
+			JOIN roles r ON r.role_id = u.role_id
+			WHERE u.email = $1
+		`, creds.Email).Scan(&userID, &storedHash, &role, &verified)
+		if err != nil && err != sql.ErrNoRows {
+			releaseAttempt(guard, creds.Email, ip)
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		if err == sql.ErrNoRows || bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(creds.Password)) != nil {
 			http.Error(w, "Неверные учётные данные", http.StatusUnauthorized)
 			return
-		} else if err != nil {
+		}
+		if !verified {
+			releaseAttempt(guard, creds.Email, ip)
+			http.Error(w, "Email не подтверждён", http.StatusForbidden)
+			return
+		}
+		enabled, err := mf.Enabled(userID)
+		if err != nil {
+			releaseAttempt(guard, creds.Email, ip)
 			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
 			return
 		}
-		if err := bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(creds.Password)); err != nil {
-			http.Error(w, "Неверные учётные данные", http.StatusUnauthorized)
+		if enabled {
+			// Only this attempt is given back: earlier failures stay until the
+			// second factor passes too, otherwise knowing the password would
+			// allow unlimited code guesses.
+			releaseAttempt(guard, creds.Email, ip)
+			challenge, err := sm.StartMFA(userID, creds.Email, role)
+			if err != nil {
+				http.Error(w, "Ошибка создания токена", http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(challenge)
 			return
 		}
-		expiration := time.Now().Add(24 * time.Hour)
-		claims := &models.Claims{
-			UserID: userID,
-			Email:  creds.Email,
-			RegisteredClaims: jwt.RegisteredClaims{
-				ExpiresAt: jwt.NewNumericDate(expiration),
-				IssuedAt:  jwt.NewNumericDate(time.Now()),
-			},
+		if err := guard.Succeeded(creds.Email, ip); err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
 		}
-		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-		tokenString, err := token.SignedString(jwtKey)
+		tokens, err := sm.Start(userID, creds.Email, role)
 		if err != nil {
 			http.Error(w, "Ошибка создания токена", http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"token":   tokenString,
-			"user_id": userID,
-		})
+		json.NewEncoder(w).Encode(tokens)
 	}
 }
@@ -5,18 +5,34 @@ import (
 	"encoding/json"
 	"net/http"
 	"server/models"
+	"server/payments"
 	"server/validators"
+	"server/vault"
 	"strconv"
 	"strings"
 )
 
+const cardColumns = `card_id, user_id, cardholder_name, last4, brand, exp_month, exp_year, is_default`
+
+func scanCard(row rowScanner) (models.PaymentCard, error) {
+	var c models.PaymentCard
+	err := row.Scan(&c.CardID, &c.UserID, &c.CardholderName, &c.Last4, &c.Brand, &c.ExpMonth, &c.ExpYear, &c.IsDefault)
+	return c, err
+}
+
+func lockUserCards(tx *sql.Tx, userID int) error {
+	_, err := tx.Exec("SELECT 1 FROM users WHERE user_id = $1 FOR UPDATE", userID)
+	return err
+}
+
 func ListCards(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		userID := getUserID(r)
 		rows, err := db.Query(`
-			SELECT card_id, user_id, cardholder_name, card_number, exp_month, exp_year
+			SELECT `+cardColumns+`
 			FROM payment_cards
 			WHERE user_id=$1
+			ORDER BY is_default DESC, card_id
 		`, userID)
 		if err != nil {
 			http.Error(w, "DB error", http.StatusInternalServerError)
@@ -25,8 +41,8 @@ func ListCards(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
 		defer rows.Close()
 		var cards []models.PaymentCard
 		for rows.Next() {
-			var c models.PaymentCard
-			if err := rows.Scan(&c.CardID, &c.UserID, &c.CardholderName, &c.CardNumber, &c.ExpMonth, &c.ExpYear); err != nil {
+			c, err := scanCard(rows)
+			if err != nil {
 				http.Error(w, "DB error", http.StatusInternalServerError)
 				return
 			}
@@ -37,7 +53,7 @@ func ListCards(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
 	}
 }
 
-func AddCard(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
+func AddCard(db *sql.DB, kr *vault.Keyring, fingerprintKey []byte, getUserID func(*http.Request) int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var req models.PaymentCard
 		if r.Method != http.MethodPost {
@@ -53,12 +69,42 @@ func AddCard(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
 			return
 		}
 		req.UserID = getUserID(r)
-		err := db.QueryRow(`
-			INSERT INTO payment_cards (user_id, cardholder_name, card_number, exp_month, exp_year)
-			VALUES ($1,$2,$3,$4,$5) RETURNING card_id
-		`, req.UserID, req.CardholderName, req.CardNumber, req.ExpMonth, req.ExpYear).
-			Scan(&req.CardID)
+		number := req.CardNumber
+		sealed, keyVersion, err := payments.SealCard(kr, req.UserID, number)
 		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		req.CardNumber = ""
+		req.Last4 = number[len(number)-4:]
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if err := lockUserCards(tx, req.UserID); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		err = tx.QueryRow(`
+			INSERT INTO payment_cards
+				(user_id, cardholder_name, card_number_enc, key_version, last4, brand, exp_month, exp_year, fingerprint, is_default)
+			VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,
+				NOT EXISTS (SELECT 1 FROM payment_cards WHERE user_id = $1 AND is_default))
+			RETURNING card_id, is_default
+		`, req.UserID, req.CardholderName, sealed, keyVersion, req.Last4, req.Brand, req.ExpMonth, req.ExpYear,
+			payments.CardFingerprint(fingerprintKey, number)).
+			Scan(&req.CardID, &req.IsDefault)
+		if isUniqueViolation(err) {
+			http.Error(w, "Card already saved", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
 			http.Error(w, "DB error", http.StatusInternalServerError)
 			return
 		}
@@ -68,6 +114,92 @@ func AddCard(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
 	}
 }
 
+func UpdateCard(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		id, err := strconv.Atoi(parts[len(parts)-1])
+		if err != nil {
+			http.Error(w, "Bad card_id", http.StatusBadRequest)
+			return
+		}
+		var req models.PaymentCardUpdate
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Bad JSON", http.StatusBadRequest)
+			return
+		}
+		userID := getUserID(r)
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if err := lockUserCards(tx, userID); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		card, err := scanCard(tx.QueryRow(`
+			SELECT `+cardColumns+`
+			FROM payment_cards
+			WHERE card_id=$1 AND user_id=$2
+		`, id, userID))
+		if err == sql.ErrNoRows {
+			http.Error(w, "Not found or forbidden", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+
+		if req.CardholderName != nil {
+			card.CardholderName = *req.CardholderName
+		}
+		if req.ExpMonth != nil {
+			card.ExpMonth = *req.ExpMonth
+		}
+		if req.ExpYear != nil {
+			card.ExpYear = *req.ExpYear
+		}
+		if err := validators.ValidateCardDetails(&card); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.IsDefault != nil && !*req.IsDefault && card.IsDefault {
+			http.Error(w, "Make another card the default instead", http.StatusBadRequest)
+			return
+		}
+		if req.IsDefault != nil && *req.IsDefault && !card.IsDefault {
+			if _, err := tx.Exec(`
+				UPDATE payment_cards SET is_default = false
+				WHERE user_id=$1 AND is_default
+			`, userID); err != nil {
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+			card.IsDefault = true
+		}
+		if _, err := tx.Exec(`
+			UPDATE payment_cards
+			SET cardholder_name=$1, exp_month=$2, exp_year=$3, is_default=$4
+			WHERE card_id=$5
+		`, card.CardholderName, card.ExpMonth, card.ExpYear, card.IsDefault, id); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(card)
+	}
+}
+
 func DeleteCard(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodDelete {
@@ -81,29 +213,72 @@ func DeleteCard(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc
 			return
 		}
 		userID := getUserID(r)
-		res, err := db.Exec(`
-			DELETE FROM payment_cards
-			WHERE card_id=$1 AND user_id=$2
-		`, id, userID)
+
+		tx, err := db.Begin()
 		if err != nil {
 			http.Error(w, "DB error", http.StatusInternalServerError)
 			return
 		}
-		if cnt, _ := res.RowsAffected(); cnt == 0 {
+		defer tx.Rollback()
+		if err := lockUserCards(tx, userID); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		var wasDefault bool
+		err = tx.QueryRow(`
+			DELETE FROM payment_cards
+			WHERE card_id=$1 AND user_id=$2
+			RETURNING is_default
+		`, id, userID).Scan(&wasDefault)
+		if err == sql.ErrNoRows {
 			http.Error(w, "Not found or forbidden", http.StatusNotFound)
 			return
+		} else if err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
+		}
+		if wasDefault {
+			if _, err := tx.Exec(`
+				UPDATE payment_cards SET is_default = true
+				WHERE card_id = (
+					SELECT card_id FROM payment_cards
+					WHERE user_id=$1
+					ORDER BY card_id DESC
+					LIMIT 1
+				)
+			`, userID); err != nil {
+				http.Error(w, "DB error", http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "DB error", http.StatusInternalServerError)
+			return
 		}
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-func CardsHandler(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
+func CardsHandler(db *sql.DB, kr *vault.Keyring, fingerprintKey []byte, getUserID func(*http.Request) int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodGet:
 			ListCards(db, getUserID)(w, r)
 		case http.MethodPost:
-			AddCard(db, getUserID)(w, r)
+			AddCard(db, kr, fingerprintKey, getUserID)(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func CardHandler(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPatch:
+			UpdateCard(db, getUserID)(w, r)
+		case http.MethodDelete:
+			DeleteCard(db, getUserID)(w, r)
 		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -28,7 +28,8 @@ func CartHandler(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc
 		}
 		rows, err := db.Query(`
 			SELECT ci.cart_item_id, ci.quantity,
-				   p.product_id,p.name,p.price::text,p.color,p.width_cm,p.height_cm,p.weight_g,p.image_url,p.description,p.quantity_in_stock,
+				   p.product_id,p.name,p.price::text,p.color,p.width_cm,p.height_cm,p.weight_g,p.image_url,p.description,
+				   CASE WHEN p.deleted_at IS NULL THEN p.quantity_in_stock ELSE 0 END,
 				   COALESCE(array_agg(c.name) FILTER (WHERE c.name IS NOT NULL), '{}')
 			FROM cart_items ci
 			JOIN products p ON p.product_id=ci.product_id
@@ -36,7 +37,7 @@ func CartHandler(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc
 			LEFT JOIN categories c ON c.category_id=pc.category_id
 			WHERE ci.cart_id=$1
 			GROUP BY ci.cart_item_id, ci.quantity,
-					 p.product_id,p.name,p.price,p.color,p.width_cm,p.height_cm,p.weight_g,p.image_url,p.description,p.quantity_in_stock
+					 p.product_id,p.name,p.price,p.color,p.width_cm,p.height_cm,p.weight_g,p.image_url,p.description,p.quantity_in_stock,p.deleted_at
 		`, cartID)
 		if err != nil {
 			http.Error(w, "DB error", http.StatusInternalServerError)
@@ -59,6 +60,7 @@ func CartHandler(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc
 				return
 			}
 			ci.Product.Categories = []string(cats)
+			ci.ExceedsStock = ci.Quantity > ci.Product.QuantityInStock
 			items = append(items, ci)
 		}
 		w.Header().Set("Content-Type", "application/json")
@@ -75,34 +77,88 @@ func AddOrUpdateItem(db *sql.DB, getUserID func(*http.Request) int) http.Handler
 		userID := getUserID(r)
 		var req models.CartRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Bad request", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, "Bad request")
+			return
+		}
+		if req.ProductID <= 0 || req.Quantity == 0 {
+			writeError(w, http.StatusBadRequest, "product_id and non-zero quantity are required")
 			return
 		}
 		var cartID int
-		if err := db.QueryRow("SELECT cart_id FROM carts WHERE user_id=$1", userID).Scan(&cartID); err == sql.ErrNoRows {
-			db.QueryRow("INSERT INTO carts(user_id) VALUES($1) RETURNING cart_id", userID).Scan(&cartID)
-		}
-		if req.Quantity < 0 {
-			_, err := db.Exec(`
-				UPDATE cart_items
-				SET quantity = GREATEST(quantity + $1, 0)
-				WHERE cart_id = $2 AND product_id = $3
-			`, req.Quantity, cartID, req.ProductID)
-			if err != nil {
-				http.Error(w, "DB error", http.StatusInternalServerError)
-				return
-			}
+		err := db.QueryRow("SELECT cart_id FROM carts WHERE user_id=$1", userID).Scan(&cartID)
+		if err == sql.ErrNoRows {
+			err = db.QueryRow("INSERT INTO carts(user_id) VALUES($1) RETURNING cart_id", userID).Scan(&cartID)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		defer tx.Rollback()
+		// Lock the cart so that concurrent requests for it see each other's
+		// quantities instead of overwriting them.
+		if _, err := tx.Exec("SELECT 1 FROM carts WHERE cart_id=$1 FOR UPDATE", cartID); err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		var name string
+		var stock int
+		err = tx.QueryRow(`
+			SELECT name, quantity_in_stock FROM products
+			WHERE product_id = $1 AND deleted_at IS NULL
+		`, req.ProductID).Scan(&name, &stock)
+		if err == sql.ErrNoRows {
+			writeJSON(w, http.StatusNotFound, models.ErrorResponse{
+				Error:     "Product not found",
+				ProductID: req.ProductID,
+			})
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		var current int
+		err = tx.QueryRow(
+			"SELECT quantity FROM cart_items WHERE cart_id=$1 AND product_id=$2", cartID, req.ProductID,
+		).Scan(&current)
+		if err != nil && err != sql.ErrNoRows {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		newQty := current + req.Quantity
+		if req.Quantity > 0 && newQty > stock {
+			writeJSON(w, http.StatusConflict, models.ErrorResponse{
+				Error: "Not enough stock",
+				Items: []models.StockError{{
+					ProductID:   req.ProductID,
+					ProductName: name,
+					Requested:   newQty,
+					Available:   stock,
+				}},
+			})
+			return
+		}
+		if newQty <= 0 {
+			_, err = tx.Exec("DELETE FROM cart_items WHERE cart_id=$1 AND product_id=$2", cartID, req.ProductID)
 		} else {
-			_, err := db.Exec(`
+			_, err = tx.Exec(`
 				INSERT INTO cart_items(cart_id, product_id, quantity)
 				VALUES($1, $2, $3)
 				ON CONFLICT (cart_id, product_id) DO
-				UPDATE SET quantity = cart_items.quantity + EXCLUDED.quantity
-			`, cartID, req.ProductID, req.Quantity)
-			if err != nil {
-				http.Error(w, "DB error", http.StatusInternalServerError)
-				return
-			}
+				UPDATE SET quantity = EXCLUDED.quantity
+			`, cartID, req.ProductID, newQty)
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
 		}
 		w.WriteHeader(http.StatusNoContent)
 	}
@@ -0,0 +1,326 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"server/models"
+	"server/validators"
+	"strconv"
+	"strings"
+)
+
+const categoriesQuery = `
+	WITH RECURSIVE tree AS (
+		SELECT category_id AS root_id, category_id FROM categories
+		UNION
+		SELECT t.root_id, c.category_id
+		FROM tree t
+		JOIN categories c ON c.parent_id = t.category_id
+	)
+	SELECT c.category_id, c.name, c.parent_id,
+	       COUNT(DISTINCT p.product_id) FILTER (
+	           WHERE p.quantity_in_stock > 0 AND p.deleted_at IS NULL
+	       )
+	FROM categories c
+	JOIN tree t                      ON t.root_id = c.category_id
+	LEFT JOIN products_categories pc ON pc.category_id = t.category_id
+	LEFT JOIN products p             ON p.product_id = pc.product_id
+	%s
+	GROUP BY c.category_id, c.name, c.parent_id
+	ORDER BY c.name`
+
+func loadCategories(db *sql.DB, where string, args ...interface{}) ([]models.Category, error) {
+	rows, err := db.Query(fmt.Sprintf(categoriesQuery, where), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	cats := []models.Category{}
+	for rows.Next() {
+		var c models.Category
+		if err := rows.Scan(&c.ID, &c.Name, &c.ParentID, &c.ProductCount); err != nil {
+			return nil, err
+		}
+		cats = append(cats, c)
+	}
+	return cats, rows.Err()
+}
+
+func buildCategoryTree(cats []models.Category) []models.Category {
+	children := make(map[int][]models.Category)
+	known := make(map[int]bool, len(cats))
+	for _, c := range cats {
+		known[c.ID] = true
+	}
+	var roots []models.Category
+	for _, c := range cats {
+		if c.ParentID == nil || !known[*c.ParentID] {
+			roots = append(roots, c)
+		} else {
+			children[*c.ParentID] = append(children[*c.ParentID], c)
+		}
+	}
+	var attach func([]models.Category) []models.Category
+	attach = func(level []models.Category) []models.Category {
+		for i := range level {
+			level[i].Children = attach(children[level[i].ID])
+		}
+		return level
+	}
+	return attach(roots)
+}
+
+func CategoriesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		cats, err := loadCategories(db, "")
+		if err != nil {
+			http.Error(w, "Ошибка чтения из БД", http.StatusInternalServerError)
+			return
+		}
+		if tree, _ := strconv.ParseBool(r.URL.Query().Get("tree")); tree {
+			cats = buildCategoryTree(cats)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cats)
+	}
+}
+
+func CategoryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "products") {
+			http.Error(w, "Неверный путь", http.StatusNotFound)
+			return
+		}
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.Error(w, "ID должен быть числом", http.StatusBadRequest)
+			return
+		}
+		cats, err := loadCategories(db, "WHERE c.category_id = $1", id)
+		if err != nil {
+			http.Error(w, "Ошибка чтения из БД", http.StatusInternalServerError)
+			return
+		}
+		if len(cats) == 0 {
+			http.Error(w, "Категория не найдена", http.StatusNotFound)
+			return
+		}
+		if len(parts) == 2 {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(cats[0])
+			return
+		}
+
+		q := r.URL.Query()
+		q.Del("category")
+		q.Set("category_id", strconv.Itoa(id))
+		f, err := parseProductFilter(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		listProducts(db, w, f)
+	}
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func decodeCategoryRequest(w http.ResponseWriter, r *http.Request) (*models.CategoryRequest, bool) {
+	var req models.CategoryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Неверный формат JSON", http.StatusBadRequest)
+		return nil, false
+	}
+	if err := validators.ValidateCategory(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return &req, true
+}
+
+// checkCategoryParent makes sure parentID exists and is not id itself or one
+// of its descendants. When re-parenting, q must be the transaction that holds
+// the categories lock, otherwise two concurrent moves can form a cycle.
+func checkCategoryParent(q queryRower, w http.ResponseWriter, parentID *int, id int) bool {
+	if parentID == nil {
+		return true
+	}
+	var exists, cycle bool
+	err := q.QueryRow(`
+		WITH RECURSIVE ancestors AS (
+			SELECT category_id, parent_id FROM categories WHERE category_id = $1
+			UNION
+			SELECT c.category_id, c.parent_id
+			FROM categories c
+			JOIN ancestors a ON c.category_id = a.parent_id
+		)
+		SELECT COUNT(*) > 0, COALESCE(bool_or(category_id = $2), false) FROM ancestors
+	`, *parentID, id).Scan(&exists, &cycle)
+	if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return false
+	}
+	if !exists {
+		http.Error(w, "Родительская категория не найдена", http.StatusBadRequest)
+		return false
+	}
+	if cycle {
+		http.Error(w, "Категория не может быть вложена сама в себя", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeCategory(db *sql.DB, w http.ResponseWriter, id, status int) {
+	cats, err := loadCategories(db, "WHERE c.category_id = $1", id)
+	if err != nil || len(cats) == 0 {
+		http.Error(w, "Ошибка чтения из БД", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(cats[0])
+}
+
+func AdminCategoriesHandler(db *sql.DB, onChange func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		req, ok := decodeCategoryRequest(w, r)
+		if !ok || !checkCategoryParent(db, w, req.ParentID, 0) {
+			return
+		}
+		var id int
+		err := db.QueryRow(`
+			INSERT INTO categories (name, parent_id) VALUES ($1, $2)
+			RETURNING category_id
+		`, req.Name, req.ParentID).Scan(&id)
+		if isUniqueViolation(err) {
+			http.Error(w, "Категория с таким названием уже существует", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		onChange()
+		writeCategory(db, w, id, http.StatusCreated)
+	}
+}
+
+func AdminCategoryHandler(db *sql.DB, onChange func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 3 {
+			http.Error(w, "Неверный путь", http.StatusNotFound)
+			return
+		}
+		id, err := strconv.Atoi(parts[2])
+		if err != nil {
+			http.Error(w, "ID должен быть числом", http.StatusBadRequest)
+			return
+		}
+		switch r.Method {
+		case http.MethodPut:
+			updateCategory(db, w, r, id, onChange)
+		case http.MethodDelete:
+			deleteCategory(db, w, id, onChange)
+		default:
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func updateCategory(db *sql.DB, w http.ResponseWriter, r *http.Request, id int, onChange func()) {
+	req, ok := decodeCategoryRequest(w, r)
+	if !ok {
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("LOCK TABLE categories IN SHARE ROW EXCLUSIVE MODE"); err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if !checkCategoryParent(tx, w, req.ParentID, id) {
+		return
+	}
+	res, err := tx.Exec(`
+		UPDATE categories SET name = $1, parent_id = $2
+		WHERE category_id = $3
+	`, req.Name, req.ParentID, id)
+	if isUniqueViolation(err) {
+		http.Error(w, "Категория с таким названием уже существует", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		http.Error(w, "Категория не найдена", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	onChange()
+	writeCategory(db, w, id, http.StatusOK)
+}
+
+func deleteCategory(db *sql.DB, w http.ResponseWriter, id int, onChange func()) {
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var hasChildren bool
+	if err := tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM categories WHERE parent_id = $1)", id,
+	).Scan(&hasChildren); err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if hasChildren {
+		http.Error(w, "Сначала удалите или перенесите подкатегории", http.StatusConflict)
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM products_categories WHERE category_id = $1", id); err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	res, err := tx.Exec("DELETE FROM categories WHERE category_id = $1", id)
+	if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	if cnt, _ := res.RowsAffected(); cnt == 0 {
+		http.Error(w, "Категория не найдена", http.StatusNotFound)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	onChange()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"server/mail"
+	"server/models"
+	"server/usertokens"
+	"strings"
+	"time"
+)
+
+var tokenMails = map[string]struct {
+	subject string
+	path    string
+	text    string
+}{
+	usertokens.VerifyEmail: {
+		subject: "Подтверждение email в PlayBox",
+		path:    "/confirm-email",
+		text:    "Чтобы подтвердить адрес и войти в PlayBox, перейдите по ссылке:",
+	},
+	usertokens.ChangeEmail: {
+		subject: "Подтверждение нового email в PlayBox",
+		path:    "/confirm-email",
+		text:    "Чтобы сделать этот адрес основным для вашего аккаунта PlayBox, перейдите по ссылке:",
+	},
+	usertokens.ResetPassword: {
+		subject: "Восстановление пароля PlayBox",
+		path:    "/reset-password",
+		text:    "Чтобы задать новый пароль, перейдите по ссылке. Она действует один час:",
+	},
+}
+
+// sendTokenMail is meant to run in its own goroutine once the token is
+// committed, so a slow mail server never holds up the response.
+func sendTokenMail(mailer mail.Mailer, baseURL, to, purpose, token string) {
+	t := tokenMails[purpose]
+	link := strings.TrimRight(baseURL, "/") + t.path + "?token=" + url.QueryEscape(token)
+	err := mailer.Send(mail.Message{
+		To:      to,
+		Subject: t.subject,
+		Body:    t.text + "\n\n" + link + "\n\nЕсли вы не запрашивали это письмо, просто проигнорируйте его.\n",
+	})
+	if err != nil {
+		log.Printf("Не удалось отправить письмо (%s) на %s: %v", purpose, to, err)
+	}
+}
+
+func ConfirmEmailHandler(db *sql.DB, tokens *usertokens.Issuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		var req models.TokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			http.Error(w, "Неверный формат JSON", http.StatusBadRequest)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		t, err := tokens.Consume(tx, req.Token, usertokens.VerifyEmail, usertokens.ChangeEmail)
+		if err == usertokens.ErrInvalidToken {
+			http.Error(w, "Ссылка недействительна или устарела", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		if t.Purpose == usertokens.ChangeEmail {
+			_, err = tx.Exec(`
+				UPDATE users SET email = $1, email_verified_at = now()
+				WHERE user_id = $2
+			`, t.NewEmail, t.UserID)
+		} else {
+			_, err = tx.Exec(`
+				UPDATE users SET email_verified_at = COALESCE(email_verified_at, now())
+				WHERE user_id = $1
+			`, t.UserID)
+		}
+		if isUniqueViolation(err) {
+			http.Error(w, "Email уже занят", http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+const (
+	// tokenMailCooldown is how long an address that has just been sent a
+	// link waits before another request sends a new one. Without it anyone
+	// could flood the mailbox and keep invalidating the link the owner is
+	// about to use.
+	tokenMailCooldown = 2 * time.Minute
+	// maxPendingMails caps the background work unauthenticated endpoints
+	// can start; requests beyond it are dropped.
+	maxPendingMails = 32
+)
+
+var pendingMails = make(chan struct{}, maxPendingMails)
+
+// mailTokenLater looks the account up, issues a token and sends it, all in
+// the background. Handlers that must not reveal whether an address is
+// registered reply before any of this work starts, so known and unknown
+// addresses take the same time. lookup must select the user row by email; it
+// is locked so that concurrent requests see each other's tokens.
+func mailTokenLater(db *sql.DB, tokens *usertokens.Issuer, mailer mail.Mailer, baseURL, email, purpose, lookup string) {
+	select {
+	case pendingMails <- struct{}{}:
+	default:
+		log.Printf("Слишком много писем в очереди, запрос (%s) для %s пропущен", purpose, email)
+		return
+	}
+	go func() {
+		defer func() { <-pendingMails }()
+		tx, err := db.Begin()
+		if err != nil {
+			log.Printf("Не удалось отправить письмо (%s): %v", purpose, err)
+			return
+		}
+		defer tx.Rollback()
+		var userID int
+		err = tx.QueryRow(lookup+" FOR UPDATE", email).Scan(&userID)
+		if err == sql.ErrNoRows {
+			return
+		} else if err != nil {
+			log.Printf("Не удалось отправить письмо (%s): %v", purpose, err)
+			return
+		}
+		recent, err := tokens.IssuedSince(tx, userID, purpose, time.Now().Add(-tokenMailCooldown))
+		if err != nil {
+			log.Printf("Не удалось отправить письмо (%s): %v", purpose, err)
+			return
+		}
+		if recent {
+			return
+		}
+		token, err := tokens.Issue(tx, userID, purpose, nil)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			log.Printf("Не удалось отправить письмо (%s): %v", purpose, err)
+			return
+		}
+		sendTokenMail(mailer, baseURL, email, purpose, token)
+	}()
+}
+
+func ResendVerificationHandler(db *sql.DB, tokens *usertokens.Issuer, mailer mail.Mailer, baseURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		var req models.EmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+			http.Error(w, "Неверный формат JSON", http.StatusBadRequest)
+			return
+		}
+		mailTokenLater(db, tokens, mailer, baseURL, req.Email, usertokens.VerifyEmail, `
+			SELECT user_id FROM users
+			WHERE email = $1 AND email_verified_at IS NULL
+		`)
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if rw.status == 0 {
+		rw.status = http.StatusOK
+	}
+	rw.body.Write(b)
+	return rw.ResponseWriter.Write(b)
+}
+
+// idempotencyLease is how long a request may hold its key before a retry
+// may assume it is dead. It is well above the longest checkout, gateway
+// calls included.
+const idempotencyLease = 5 * time.Minute
+
+func Idempotent(db *sql.DB, getUserID func(*http.Request) int, ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeError(w, http.StatusBadRequest, "Idempotency-Key is too long")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Bad request")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		hash := hex.EncodeToString(sum[:])
+		userID := getUserID(r)
+
+		// A key whose request never finished, because the process died in
+		// between, is taken over once its lease runs out; an expired key is
+		// reused as if it were new.
+		res, err := db.Exec(`
+			INSERT INTO idempotency_keys (user_id, idem_key, request_hash)
+			VALUES ($1, $2, $3)
+			ON CONFLICT (user_id, idem_key) DO UPDATE
+			SET request_hash = EXCLUDED.request_hash, status_code = NULL,
+			    response_body = NULL, created_at = now()
+			WHERE idempotency_keys.created_at < now() - $4 * interval '1 second'
+			   OR (idempotency_keys.status_code IS NULL
+			       AND idempotency_keys.request_hash = EXCLUDED.request_hash
+			       AND idempotency_keys.created_at < now() - $5 * interval '1 second')
+		`, userID, key, hash, int(ttl.Seconds()), int(idempotencyLease.Seconds()))
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		if cnt, _ := res.RowsAffected(); cnt == 0 {
+			var storedHash string
+			var status sql.NullInt64
+			var stored []byte
+			err := db.QueryRow(`
+				SELECT request_hash, status_code, response_body
+				FROM idempotency_keys
+				WHERE user_id = $1 AND idem_key = $2
+			`, userID, key).Scan(&storedHash, &status, &stored)
+			if err == sql.ErrNoRows {
+				writeError(w, http.StatusConflict, "Request with this Idempotency-Key is in progress")
+				return
+			} else if err != nil {
+				writeError(w, http.StatusInternalServerError, "DB error")
+				return
+			}
+			switch {
+			case storedHash != hash:
+				writeError(w, http.StatusUnprocessableEntity, "Idempotency-Key was used with a different request")
+			case !status.Valid:
+				writeError(w, http.StatusConflict, "Request with this Idempotency-Key is in progress")
+			default:
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(int(status.Int64))
+				w.Write(stored)
+			}
+			return
+		}
+
+		rec := &recordingWriter{ResponseWriter: w}
+		next(rec, r)
+		if rec.status >= 200 && rec.status < 300 {
+			_, err = db.Exec(`
+				UPDATE idempotency_keys SET status_code = $1, response_body = $2
+				WHERE user_id = $3 AND idem_key = $4
+			`, rec.status, rec.body.Bytes(), userID, key)
+		} else {
+			_, err = db.Exec(
+				"DELETE FROM idempotency_keys WHERE user_id = $1 AND idem_key = $2", userID, key,
+			)
+		}
+		if err != nil {
+			log.Printf("Не удалось сохранить ключ идемпотентности %q: %v", key, err)
+		}
+	}
+}
+
+// PurgeIdempotencyKeysEvery deletes keys older than ttl. Expired keys are
+// ignored by Idempotent anyway; this only keeps the table small.
+func PurgeIdempotencyKeysEvery(db *sql.DB, interval, ttl time.Duration) {
+	for range time.Tick(interval) {
+		if _, err := db.Exec(
+			"DELETE FROM idempotency_keys WHERE created_at < now() - $1 * interval '1 second'",
+			int(ttl.Seconds()),
+		); err != nil {
+			log.Printf("Не удалось очистить ключи идемпотентности: %v", err)
+		}
+	}
+}
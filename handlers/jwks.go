@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"server/jwtkeys"
+)
+
+// JWKSHandler publishes the token verification keys. A service that accepts
+// PlayBox access tokens must pick the key by kid, require the alg of that key,
+// check exp and require both aud "playbox-api" and the "at+jwt" typ header.
+// Other tokens signed with the same keys, such as the one issued between the
+// password and the second factor, carry a different audience and typ and must
+// be rejected.
+func JWKSHandler(ks *jwtkeys.KeySet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "public, max-age=300")
+		json.NewEncoder(w).Encode(ks.JWKS())
+	}
+}
@@ -0,0 +1,138 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"server/loginguard"
+	"server/mfa"
+	"server/models"
+	"server/sessions"
+	"strings"
+)
+
+func MFALoginHandler(sm *sessions.Manager, mf *mfa.Manager, guard *loginguard.Guard) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		var req models.MFALoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MFAToken == "" || req.Code == "" {
+			http.Error(w, "Неверный формат JSON", http.StatusBadRequest)
+			return
+		}
+		claims, err := sm.ParseMFA(req.MFAToken)
+		if err != nil {
+			http.Error(w, "Токен недействителен, войдите заново", http.StatusUnauthorized)
+			return
+		}
+		ip := guard.ClientIP(r)
+		if !reserveAttempt(w, guard, claims.Email, ip) {
+			return
+		}
+		err = mf.Verify(claims.UserID, req.Code)
+		if err == mfa.ErrInvalidCode || err == mfa.ErrNotEnrolled {
+			http.Error(w, "Неверный код", http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			releaseAttempt(guard, claims.Email, ip)
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		if err := guard.Succeeded(claims.Email, ip); err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		tokens, err := sm.Start(claims.UserID, claims.Email, claims.Role)
+		if err != nil {
+			http.Error(w, "Ошибка создания токена", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(tokens)
+	}
+}
+
+func writeMFAError(w http.ResponseWriter, err error) {
+	switch err {
+	case mfa.ErrInvalidCode:
+		http.Error(w, "Неверный код", http.StatusBadRequest)
+	case mfa.ErrNotEnrolled:
+		http.Error(w, "Двухфакторная аутентификация не настроена", http.StatusConflict)
+	case mfa.ErrAlreadyEnabled:
+		http.Error(w, "Двухфакторная аутентификация уже включена", http.StatusConflict)
+	default:
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+	}
+}
+
+// TwoFactorHandler changes the 2FA setup of the signed-in user. Confirm and
+// disable take a code, so they go through the login guard of the account
+// like the second login step does: a stolen access token must not allow
+// unlimited guesses.
+func TwoFactorHandler(db *sql.DB, mf *mfa.Manager, guard *loginguard.Guard, getUserID func(*http.Request) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 4 {
+			http.Error(w, "Неверный путь", http.StatusNotFound)
+			return
+		}
+		userID := getUserID(r)
+		var email string
+		if err := db.QueryRow("SELECT email FROM users WHERE user_id = $1", userID).Scan(&email); err != nil {
+			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+			return
+		}
+		switch parts[3] {
+		case "enroll":
+			secret, uri, err := mf.Enroll(userID, email)
+			if err != nil {
+				writeMFAError(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(models.MFAEnrollment{Secret: secret, OtpauthURI: uri})
+		case "confirm", "disable":
+			var req models.MFACodeRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+				http.Error(w, "Неверный формат JSON", http.StatusBadRequest)
+				return
+			}
+			ip := guard.ClientIP(r)
+			if !reserveAttempt(w, guard, email, ip) {
+				return
+			}
+			var codes []string
+			var err error
+			if parts[3] == "disable" {
+				err = mf.Disable(userID, req.Code)
+			} else {
+				codes, err = mf.Confirm(userID, req.Code)
+			}
+			if err != nil {
+				if err != mfa.ErrInvalidCode {
+					releaseAttempt(guard, email, ip)
+				}
+				writeMFAError(w, err)
+				return
+			}
+			if err := guard.Succeeded(email, ip); err != nil {
+				http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+				return
+			}
+			if codes == nil {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(models.RecoveryCodes{Codes: codes})
+		default:
+			http.Error(w, "Неверный путь", http.StatusNotFound)
+		}
+	}
+}
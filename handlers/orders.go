@@ -2,146 +2,477 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/base64"
 	"encoding/json"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"server/models"
+	"server/orderstatus"
+	"server/payments"
+	"server/vault"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
 )
 
-func CheckoutHandler(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
+type checkoutLine struct {
+	productID int
+	quantity  int
+	name      string
+	price     string
+	stock     int
+	available bool
+}
+
+func CheckoutHandler(db *sql.DB, gw payments.Gateway, kr *vault.Keyring, getUserID func(*http.Request) int) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 			return
 		}
 		userID := getUserID(r)
 		var req models.CheckoutRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			http.Error(w, "Bad request", http.StatusBadRequest)
-			return
-		}
-		if len(req.Items) == 0 {
-			http.Error(w, "No items", http.StatusBadRequest)
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeError(w, http.StatusBadRequest, "Bad request")
 			return
 		}
 		tx, err := db.Begin()
 		if err != nil {
-			http.Error(w, "DB error", http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, "DB error")
 			return
 		}
 		defer tx.Rollback()
+		var cartID int
+		err = tx.QueryRow("SELECT cart_id FROM carts WHERE user_id=$1 FOR UPDATE", userID).Scan(&cartID)
+		if err == sql.ErrNoRows {
+			writeError(w, http.StatusBadRequest, "Cart is empty")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		var subset interface{}
+		if len(req.ProductIDs) > 0 {
+			subset = pq.Array(req.ProductIDs)
+		}
+		rows, err := tx.Query(`
+			SELECT ci.product_id, ci.quantity, p.name, p.price::text, p.quantity_in_stock, p.deleted_at IS NULL
+			FROM cart_items ci
+			JOIN products p ON p.product_id = ci.product_id
+			WHERE ci.cart_id = $1 AND ($2::int[] IS NULL OR ci.product_id = ANY($2))
+			ORDER BY p.product_id
+			FOR UPDATE OF p
+		`, cartID, subset)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		var lines []checkoutLine
+		for rows.Next() {
+			var l checkoutLine
+			if err := rows.Scan(&l.productID, &l.quantity, &l.name, &l.price, &l.stock, &l.available); err != nil {
+				rows.Close()
+				writeError(w, http.StatusInternalServerError, "DB error")
+				return
+			}
+			lines = append(lines, l)
+		}
+		rows.Close()
+		if len(lines) == 0 {
+			writeError(w, http.StatusBadRequest, "Cart is empty")
+			return
+		}
+		if len(req.ProductIDs) > 0 {
+			inCart := make(map[int]bool, len(lines))
+			for _, l := range lines {
+				inCart[l.productID] = true
+			}
+			for _, id := range req.ProductIDs {
+				if !inCart[id] {
+					writeJSON(w, http.StatusBadRequest, models.ErrorResponse{
+						Error:     "Product is not in cart",
+						ProductID: id,
+					})
+					return
+				}
+			}
+		}
+		var short []models.StockError
+		for _, l := range lines {
+			available := l.stock
+			if !l.available {
+				available = 0
+			}
+			if l.quantity > available {
+				short = append(short, models.StockError{
+					ProductID:   l.productID,
+					ProductName: l.name,
+					Requested:   l.quantity,
+					Available:   available,
+				})
+			}
+		}
+		if len(short) > 0 {
+			writeJSON(w, http.StatusConflict, models.ErrorResponse{
+				Error: "Not enough stock",
+				Items: short,
+			})
+			return
+		}
 		var orderID int
 		err = tx.QueryRow(`
 			INSERT INTO orders (user_id, status_id)
-			VALUES ($1, (SELECT status_id FROM order_statuses WHERE status_name='Новый'))
+			VALUES ($1, (SELECT status_id FROM order_statuses WHERE status_name=$2))
 			RETURNING order_id
-		`, userID).Scan(&orderID)
+		`, userID, orderstatus.New).Scan(&orderID)
 		if err != nil {
-			http.Error(w, "DB error creating order", http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, "DB error creating order")
+			return
+		}
+		if err := orderstatus.Record(tx, orderID, "", orderstatus.New, userID, ""); err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error creating order")
 			return
 		}
-		for _, it := range req.Items {
+		ordered := make([]int, 0, len(lines))
+		for _, l := range lines {
 			if _, err := tx.Exec(`
 				UPDATE products
-				SET quantity_in_stock = GREATEST(quantity_in_stock - $1, 0)
+				SET quantity_in_stock = quantity_in_stock - $1
 				WHERE product_id = $2
-			`, it.Quantity, it.ProductID); err != nil {
-				http.Error(w, "DB error updating stock", http.StatusInternalServerError)
+			`, l.quantity, l.productID); err != nil {
+				writeError(w, http.StatusInternalServerError, "DB error updating stock")
 				return
 			}
-			if _, err := tx.Exec(`
-				INSERT INTO order_items (order_id, product_id, quantity)
-				VALUES ($1, $2, $3)
-			`, orderID, it.ProductID, it.Quantity); err != nil {
-				http.Error(w, "DB error inserting order_items", http.StatusInternalServerError)
+			var orderItemID int
+			if err := tx.QueryRow(`
+				INSERT INTO order_items (order_id, product_id, quantity, unit_price, product_name)
+				VALUES ($1, $2, $3, $4, $5)
+				RETURNING order_item_id
+			`, orderID, l.productID, l.quantity, l.price, l.name).Scan(&orderItemID); err != nil {
+				writeError(w, http.StatusInternalServerError, "DB error inserting order_items")
 				return
 			}
-			if _, err := tx.Exec(`
-				DELETE FROM cart_items
-				WHERE cart_id = (SELECT cart_id FROM carts WHERE user_id=$1)
-				  AND product_id = $2
-			`, userID, it.ProductID); err != nil {
-				http.Error(w, "DB error clearing cart", http.StatusInternalServerError)
+			if err := orderstatus.Allocate(tx, orderItemID, l.productID, l.quantity); err != nil {
+				writeError(w, http.StatusInternalServerError, "DB error allocating stock")
 				return
 			}
+			ordered = append(ordered, l.productID)
+		}
+		if _, err := tx.Exec(`
+			DELETE FROM cart_items
+			WHERE cart_id = $1 AND product_id = ANY($2)
+		`, cartID, pq.Array(ordered)); err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error clearing cart")
+			return
+		}
+		cardID := 0
+		if req.CardID != nil {
+			cardID = *req.CardID
+		} else if cardID, err = payments.DefaultCard(tx, userID); err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error reading default card")
+			return
+		}
+		var payment *models.Payment
+		if cardID != 0 {
+			p, err := payments.Begin(tx, orderID, userID, cardID)
+			if !writePaymentError(w, err) {
+				return
+			}
+			payment = &p
 		}
 		if err := tx.Commit(); err != nil {
-			http.Error(w, "DB error commit", http.StatusInternalServerError)
+			writeError(w, http.StatusInternalServerError, "DB error commit")
 			return
 		}
-		w.WriteHeader(http.StatusNoContent)
+		if payment != nil {
+			_, err := payments.Process(r.Context(), db, gw, kr, *payment, userID)
+			if err != nil {
+				restoreCart(db, cartID, orderID)
+			}
+			if !writePaymentError(w, err) {
+				return
+			}
+		}
+		writeOrderDetails(db, w, http.StatusCreated, orderID, userID)
 	}
 }
 
-func ListOrdersHandler(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		userID := getUserID(r)
-		query := `
-			WITH order_totals AS (
-				SELECT 
-					o.order_id,
-					COUNT(oi.order_item_id) as total_items,
-					CAST(SUM(CAST(p.price AS DECIMAL(10,2)) * oi.quantity) AS VARCHAR) as total_amount
-				FROM orders o
-				LEFT JOIN order_items oi ON o.order_id = oi.order_id
-				LEFT JOIN products p ON oi.product_id = p.product_id
-				GROUP BY o.order_id
+// restoreCart puts the items of an order whose payment failed back into the
+// cart, so that the customer can try again with another card. Orders that
+// were not cancelled are left alone.
+func restoreCart(db *sql.DB, cartID, orderID int) {
+	_, err := db.Exec(`
+		INSERT INTO cart_items (cart_id, product_id, quantity)
+		SELECT $1, oi.product_id, SUM(oi.quantity)
+		FROM order_items oi
+		JOIN orders o ON o.order_id = oi.order_id
+		JOIN order_statuses os ON os.status_id = o.status_id
+		WHERE oi.order_id = $2 AND os.status_name = $3
+		GROUP BY oi.product_id
+		ON CONFLICT (cart_id, product_id) DO UPDATE
+		SET quantity = cart_items.quantity + EXCLUDED.quantity
+	`, cartID, orderID, orderstatus.Cancelled)
+	if err != nil {
+		log.Printf("Не удалось вернуть товары заказа %d в корзину: %v", orderID, err)
+	}
+}
+
+const (
+	defaultOrdersLimit = 20
+	maxOrdersLimit     = 100
+)
+
+const ordersQuery = `
+	SELECT 
+		o.order_id,
+		os.status_name as status,
+		o.order_ts,
+		COUNT(oi.order_item_id) as total_items,
+		COALESCE(CAST(SUM(oi.unit_price * oi.quantity) AS VARCHAR), '0') as total_amount,
+		o.user_id,
+		json_agg(
+			json_build_object(
+				'product_id', oi.product_id,
+				'quantity', oi.quantity,
+				'product_name', oi.product_name,
+				'price', oi.unit_price
 			)
-			SELECT 
-				o.order_id,
-				os.status_name as status,
-				o.order_ts,
-				COALESCE(ot.total_items, 0) as total_items,
-				COALESCE(ot.total_amount, '0') as total_amount,
-				o.user_id,
-				json_agg(
-					json_build_object(
-						'product_id', p.product_id,
-						'quantity', oi.quantity,
-						'product_name', p.name,
-						'price', p.price
-					)
-				) as items
-			FROM orders o
-			LEFT JOIN order_statuses os ON o.status_id = os.status_id
-			LEFT JOIN order_totals ot ON o.order_id = ot.order_id
-			LEFT JOIN order_items oi ON o.order_id = oi.order_id
-			LEFT JOIN products p ON oi.product_id = p.product_id
-			WHERE o.user_id = $1
-			GROUP BY o.order_id, os.status_name, o.order_ts, ot.total_items, ot.total_amount, o.user_id
-			ORDER BY o.order_ts DESC`
-		rows, err := db.Query(query, userID)
+		) as items
+	FROM orders o
+	LEFT JOIN order_statuses os ON o.status_id = os.status_id
+	LEFT JOIN order_items oi ON o.order_id = oi.order_id
+	WHERE %s
+	GROUP BY o.order_id, os.status_name, o.order_ts, o.user_id
+	ORDER BY o.order_ts DESC, o.order_id DESC
+	%s`
+
+func queryOrders(db *sql.DB, where, limit string, args ...interface{}) ([]models.OrderSummary, error) {
+	rows, err := db.Query(fmt.Sprintf(ordersQuery, where, limit), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	orders := []models.OrderSummary{}
+	for rows.Next() {
+		var order models.OrderSummary
+		var itemsJSON string
+		err := rows.Scan(
+			&order.OrderID,
+			&order.Status,
+			&order.OrderTS,
+			&order.TotalItems,
+			&order.TotalAmount,
+			&order.UserID,
+			&itemsJSON,
+		)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(itemsJSON), &order.Items); err != nil {
+			return nil, err
+		}
+		orders = append(orders, order)
+	}
+	return orders, rows.Err()
+}
+
+func loadOrder(db *sql.DB, orderID, userID int) (models.OrderSummary, error) {
+	orders, err := queryOrders(db, "o.order_id = $1 AND ($2 = 0 OR o.user_id = $2)", "", orderID, userID)
+	if err != nil {
+		return models.OrderSummary{}, err
+	}
+	if len(orders) == 0 {
+		return models.OrderSummary{}, sql.ErrNoRows
+	}
+	return orders[0], nil
+}
+
+func encodeOrderCursor(o models.OrderSummary) string {
+	raw := o.OrderTS.UTC().Format(time.RFC3339Nano) + "|" + strconv.Itoa(o.OrderID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeOrderCursor(cursor string) (time.Time, int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return time.Time{}, 0, fmt.Errorf("malformed cursor")
+	}
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return time.Time{}, 0, err
+	}
+	n, err := strconv.Atoi(id)
+	return t, n, err
+}
+
+func parseOrderDate(v string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", v)
+	if err == nil && endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, err
+}
+
+func ListOrdersHandler(db *sql.DB, getUserID func(*http.Request) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 			return
 		}
-		defer rows.Close()
-		var orders []models.OrderSummary
-		for rows.Next() {
-			var order models.OrderSummary
-			var itemsJSON string
-			err := rows.Scan(
-				&order.OrderID,
-				&order.Status,
-				&order.OrderTS,
-				&order.TotalItems,
-				&order.TotalAmount,
-				&order.UserID,
-				&itemsJSON,
-			)
+		q := r.URL.Query()
+		where := []string{"o.user_id = $1"}
+		args := []interface{}{getUserID(r)}
+		add := func(cond string, vals ...interface{}) {
+			for _, v := range vals {
+				args = append(args, v)
+				cond = strings.Replace(cond, "?", "$"+strconv.Itoa(len(args)), 1)
+			}
+			where = append(where, cond)
+		}
+
+		if statuses := q["status"]; len(statuses) > 0 {
+			add("os.status_name = ANY(?)", pq.Array(statuses))
+		}
+		if v := q.Get("from"); v != "" {
+			t, err := parseOrderDate(v, false)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "from must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+				return
+			}
+			add("o.order_ts >= ?", t)
+		}
+		if v := q.Get("to"); v != "" {
+			t, err := parseOrderDate(v, true)
 			if err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+				writeError(w, http.StatusBadRequest, "to must be a date (YYYY-MM-DD) or RFC 3339 timestamp")
+				return
+			}
+			add("o.order_ts < ?", t)
+		}
+		if v := q.Get("cursor"); v != "" {
+			ts, id, err := decodeOrderCursor(v)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, "Bad cursor")
+				return
+			}
+			add("(o.order_ts, o.order_id) < (?, ?)", ts, id)
+		}
+		limit := defaultOrdersLimit
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > maxOrdersLimit {
+				writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxOrdersLimit))
 				return
 			}
-			if err := json.Unmarshal([]byte(itemsJSON), &order.Items); err != nil {
-				w.WriteHeader(http.StatusInternalServerError)
+			limit = n
+		}
+
+		args = append(args, limit+1)
+		orders, err := queryOrders(db, strings.Join(where, " AND "), "LIMIT $"+strconv.Itoa(len(args)), args...)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "DB error")
+			return
+		}
+		list := models.OrderList{Items: orders}
+		if len(orders) > limit {
+			list.Items = orders[:limit]
+			list.NextCursor = encodeOrderCursor(orders[limit-1])
+		}
+		writeJSON(w, http.StatusOK, list)
+	}
+}
+
+func OrderHandler(db *sql.DB, gw payments.Gateway, getUserID func(*http.Request) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && parts[2] != "cancel") {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Bad order_id")
+			return
+		}
+		userID := getUserID(r)
+		if len(parts) == 3 {
+			if r.Method != http.MethodPost {
+				writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 				return
 			}
-			orders = append(orders, order)
+			cancelOrder(db, gw, w, r, id, userID)
+			return
 		}
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(orders); err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
 			return
 		}
+		writeOrderDetails(db, w, http.StatusOK, id, userID)
+	}
+}
+
+func cancelOrder(db *sql.DB, gw payments.Gateway, w http.ResponseWriter, r *http.Request, id, userID int) {
+	var req models.OrderStatusRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "Bad request")
+		return
+	}
+	if utf8.RuneCountInString(req.Comment) > 500 {
+		writeError(w, http.StatusBadRequest, "comment must be at most 500 characters")
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	defer tx.Rollback()
+	_, err = orderstatus.CustomerCancel(tx, id, userID, req.Comment)
+	if !writeTransitionError(w, err) {
+		return
+	}
+	if err := payments.CloseForOrder(tx, id); err != nil {
+		writeError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	// A refund the gateway refuses now stays refund_pending in the response
+	// and is retried in the background.
+	payments.Refund(r.Context(), db, gw, id)
+	writeOrderDetails(db, w, http.StatusOK, id, userID)
+}
+
+func writeOrderDetails(db *sql.DB, w http.ResponseWriter, status, id, ownerID int) {
+	order, err := loadOrder(db, id, ownerID)
+	if err == sql.ErrNoRows {
+		writeError(w, http.StatusNotFound, "Order not found")
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	if order.History, err = orderstatus.History(db, id); err != nil {
+		writeError(w, http.StatusInternalServerError, "DB error")
+		return
+	}
+	if order.Payment, err = payments.ForOrder(db, id); err != nil {
+		writeError(w, http.StatusInternalServerError, "DB error")
+		return
 	}
+	writeJSON(w, status, order)
 }
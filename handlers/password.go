@@ -4,7 +4,11 @@ import (
 	"database/sql"
 	"encoding/json"
 	"net/http"
+	"server/mail"
 	"server/models"
+	"server/sessions"
+	"server/usertokens"
+	"unicode/utf8"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -41,13 +45,102 @@ func ChangePasswordHandler(db *sql.DB, getUserID func(*http.Request) int) http.H
 			http.Error(w, "Server error", http.StatusInternalServerError)
 			return
 		}
-		if _, err := db.Exec(
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if _, err := tx.Exec(
 			"UPDATE users SET password_hash=$1 WHERE user_id=$2",
 			string(newHash), userID,
 		); err != nil {
 			http.Error(w, "Server error", http.StatusInternalServerError)
 			return
 		}
+		if err := sessions.RevokeAll(tx, userID); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ForgotPasswordHandler replies 202 whether or not the email belongs to an
+// account; the reset mail is prepared and sent by mailTokenLater.
+func ForgotPasswordHandler(db *sql.DB, tokens *usertokens.Issuer, mailer mail.Mailer, baseURL string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req models.EmailRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Email == "" {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		mailTokenLater(db, tokens, mailer, baseURL, req.Email, usertokens.ResetPassword,
+			"SELECT user_id FROM users WHERE email=$1")
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func ResetPasswordHandler(db *sql.DB, tokens *usertokens.Issuer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req models.PasswordResetRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		if utf8.RuneCountInString(req.NewPassword) < 6 {
+			http.Error(w, "password must be at least 6 characters", http.StatusBadRequest)
+			return
+		}
+		newHash, err := bcrypt.GenerateFromPassword(
+			[]byte(req.NewPassword), bcrypt.DefaultCost,
+		)
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		t, err := tokens.Consume(tx, req.Token, usertokens.ResetPassword)
+		if err == usertokens.ErrInvalidToken {
+			http.Error(w, "Reset link is invalid or expired", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if _, err := tx.Exec(`
+			UPDATE users
+			SET password_hash=$1, email_verified_at=COALESCE(email_verified_at, now())
+			WHERE user_id=$2
+		`, string(newHash), t.UserID); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if err := sessions.RevokeAll(tx, t.UserID); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Server error", http.StatusInternalServerError)
+			return
+		}
 		w.WriteHeader(http.StatusNoContent)
 	}
 }
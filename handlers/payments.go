@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"server/models"
+	"server/payments"
+	"strconv"
+	"strings"
+)
+
+func writePaymentError(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return true
+	}
+	if e, ok := err.(*payments.DeclinedError); ok {
+		writeError(w, http.StatusPaymentRequired, e.Error())
+		return false
+	}
+	switch err {
+	case payments.ErrCardNotFound:
+		writeError(w, http.StatusNotFound, "Card not found")
+	case payments.ErrPaymentNotFound:
+		writeError(w, http.StatusNotFound, "Payment not found")
+	case payments.ErrNotConfirmable, payments.ErrPaymentClosed:
+		writeError(w, http.StatusConflict, err.Error())
+	default:
+		writeError(w, http.StatusBadGateway, "Payment gateway error")
+	}
+	return false
+}
+
+func PaymentHandler(db *sql.DB, gw payments.Gateway, getUserID func(*http.Request) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 3 || parts[2] != "confirm" {
+			writeError(w, http.StatusNotFound, "Not found")
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Bad payment_id")
+			return
+		}
+		var req models.PaymentConfirmRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "Bad request")
+			return
+		}
+		userID := getUserID(r)
+		payment, err := payments.Confirm(r.Context(), db, gw, id, userID, req.Code)
+		if !writePaymentError(w, err) {
+			return
+		}
+		writeOrderDetails(db, w, http.StatusOK, payment.OrderID, userID)
+	}
+}
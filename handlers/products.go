@@ -2,7 +2,11 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 
 	"database/sql"
 	"server/models"
@@ -10,15 +14,13 @@ import (
 	"github.com/lib/pq"
 )
 
-func ProductsHandler(db *sql.DB) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
-			return
-		}
+const (
+	defaultProductsLimit = 50
+	maxProductsLimit     = 100
+)
 
-		query := `
-		SELECT
+const (
+	productColumns = `
 		  p.product_id,
 		  p.name,
 		  p.price::text,
@@ -29,40 +31,249 @@ func ProductsHandler(db *sql.DB) http.HandlerFunc {
 		  p.image_url,
 		  p.description,
 		  p.quantity_in_stock,
-		  COALESCE(array_agg(c.name) FILTER (WHERE c.name IS NOT NULL), '{}') AS categories
+		  COALESCE(array_agg(c.name) FILTER (WHERE c.name IS NOT NULL), '{}') AS categories`
+	productJoins = `
 		FROM products p
 		LEFT JOIN products_categories pc ON pc.product_id = p.product_id
-		LEFT JOIN categories c            ON c.category_id = pc.category_id
-		GROUP BY
+		LEFT JOIN categories c            ON c.category_id = pc.category_id`
+	productGroupBy = `
 		  p.product_id, p.name, p.price, p.color, p.width_cm,
-		  p.height_cm, p.weight_g, p.image_url, p.description, p.quantity_in_stock
-		`
+		  p.height_cm, p.weight_g, p.image_url, p.description, p.quantity_in_stock`
+)
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanProduct(row rowScanner, extra ...interface{}) (models.Product, error) {
+	var p models.Product
+	var cats pq.StringArray
+	err := row.Scan(append([]interface{}{
+		&p.ID, &p.Name, &p.Price,
+		&p.Color, &p.WidthCm, &p.HeightCm,
+		&p.WeightG, &p.ImageURL, &p.Description, &p.QuantityInStock,
+		&cats,
+	}, extra...)...)
+	p.Categories = []string(cats)
+	return p, err
+}
+
+func loadProduct(db *sql.DB, id int) (models.Product, error) {
+	return scanProduct(db.QueryRow(
+		"SELECT "+productColumns+productJoins+
+			" WHERE p.product_id = $1 AND p.deleted_at IS NULL GROUP BY "+productGroupBy, id,
+	))
+}
+
+var productSorts = map[string]string{
+	"":           "p.product_id ASC",
+	"price_asc":  "p.price ASC, p.product_id ASC",
+	"price_desc": "p.price DESC, p.product_id DESC",
+	"name_asc":   "p.name ASC",
+	"name_desc":  "p.name DESC",
+	"newest":     "p.product_id DESC",
+}
+
+type productFilter struct {
+	where  []string
+	args   []interface{}
+	order  string
+	limit  int
+	offset int
+}
+
+func (f *productFilter) add(cond string, arg interface{}) {
+	f.args = append(f.args, arg)
+	f.where = append(f.where, strings.ReplaceAll(cond, "?", "$"+strconv.Itoa(len(f.args))))
+}
+
+func (f *productFilter) whereSQL() string {
+	if len(f.where) == 0 {
+		return ""
+	}
+	return "WHERE " + strings.Join(f.where, " AND ")
+}
+
+func parseProductFilter(q url.Values) (*productFilter, error) {
+	f := &productFilter{
+		where: []string{"p.deleted_at IS NULL"},
+		limit: defaultProductsLimit,
+	}
 
-		rows, err := db.Query(query)
+	if cats := q["category"]; len(cats) > 0 {
+		f.add(`EXISTS (
+			SELECT 1 FROM products_categories fpc
+			JOIN categories fc ON fc.category_id = fpc.category_id
+			WHERE fpc.product_id = p.product_id AND fc.name = ANY(?)
+		)`, pq.Array(cats))
+	}
+	if v := q.Get("category_id"); v != "" {
+		id, err := strconv.Atoi(v)
 		if err != nil {
-			http.Error(w, "Ошибка чтения из БД", http.StatusInternalServerError)
-			return
+			return nil, fmt.Errorf("category_id должен быть числом")
+		}
+		f.add(`EXISTS (
+			SELECT 1 FROM products_categories fpc
+			WHERE fpc.product_id = p.product_id AND fpc.category_id IN (
+				WITH RECURSIVE sub AS (
+					SELECT category_id FROM categories WHERE category_id = ?
+					UNION
+					SELECT fc.category_id FROM categories fc JOIN sub ON fc.parent_id = sub.category_id
+				)
+				SELECT category_id FROM sub
+			)
+		)`, id)
+	}
+	if colors := q["color"]; len(colors) > 0 {
+		lowered := make([]string, len(colors))
+		for i, c := range colors {
+			lowered[i] = strings.ToLower(c)
+		}
+		f.add("lower(p.color) = ANY(?)", pq.Array(lowered))
+	}
+	for _, rng := range []struct{ param, cond string }{
+		{"min_price", "p.price >= ?"},
+		{"max_price", "p.price <= ?"},
+	} {
+		if v := q.Get(rng.param); v != "" {
+			price, err := strconv.ParseFloat(v, 64)
+			if err != nil || price < 0 {
+				return nil, fmt.Errorf("%s должен быть неотрицательным числом", rng.param)
+			}
+			f.add(rng.cond, price)
 		}
-		defer rows.Close()
-
-		var products []models.Product
-		for rows.Next() {
-			var p models.Product
-			var cats pq.StringArray
-			if err := rows.Scan(
-				&p.ID, &p.Name, &p.Price,
-				&p.Color, &p.WidthCm, &p.HeightCm,
-				&p.WeightG, &p.ImageURL, &p.Description, &p.QuantityInStock,
-				&cats,
-			); err != nil {
-				http.Error(w, "Ошибка обработки данных", http.StatusInternalServerError)
-				return
+	}
+	for _, rng := range []struct{ param, cond string }{
+		{"min_width", "p.width_cm >= ?"},
+		{"max_width", "p.width_cm <= ?"},
+		{"min_height", "p.height_cm >= ?"},
+		{"max_height", "p.height_cm <= ?"},
+		{"min_weight", "p.weight_g >= ?"},
+		{"max_weight", "p.weight_g <= ?"},
+	} {
+		if v := q.Get(rng.param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("%s должен быть неотрицательным целым числом", rng.param)
 			}
-			p.Categories = []string(cats)
-			products = append(products, p)
+			f.add(rng.cond, n)
+		}
+	}
+	if v := q.Get("in_stock"); v != "" {
+		inStock, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("in_stock должен быть true или false")
+		}
+		if inStock {
+			f.where = append(f.where, "p.quantity_in_stock > 0")
+		}
+	}
+
+	order, ok := productSorts[q.Get("sort")]
+	if !ok {
+		return nil, fmt.Errorf("неизвестная сортировка: %s", q.Get("sort"))
+	}
+	f.order = order
+
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxProductsLimit {
+			return nil, fmt.Errorf("limit должен быть от 1 до %d", maxProductsLimit)
+		}
+		f.limit = n
+	}
+	if v := q.Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("offset должен быть неотрицательным целым числом")
+		}
+		f.offset = n
+	}
+	return f, nil
+}
+
+func listProducts(db *sql.DB, w http.ResponseWriter, f *productFilter) {
+	list := models.ProductList{Items: []models.Product{}, Limit: f.limit, Offset: f.offset}
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM products p "+f.whereSQL(), f.args...,
+	).Scan(&list.Total); err != nil {
+		http.Error(w, "Ошибка чтения из БД", http.StatusInternalServerError)
+		return
+	}
+
+	args := append(f.args, f.limit, f.offset)
+	query := fmt.Sprintf(`
+	SELECT %s
+	%s
+	%s
+	GROUP BY %s
+	ORDER BY %s
+	LIMIT $%d OFFSET $%d
+	`, productColumns, productJoins, f.whereSQL(), productGroupBy, f.order, len(args)-1, len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, "Ошибка чтения из БД", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			http.Error(w, "Ошибка обработки данных", http.StatusInternalServerError)
+			return
+		}
+		list.Items = append(list.Items, p)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func ProductsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+
+		f, err := parseProductFilter(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		listProducts(db, w, f)
+	}
+}
+
+func ProductHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 2 {
+			http.Error(w, "Неверный путь", http.StatusBadRequest)
+			return
+		}
+		id, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.Error(w, "ID должен быть числом", http.StatusBadRequest)
+			return
+		}
+
+		p, err := loadProduct(db, id)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Товар не найден", http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, "Ошибка чтения из БД", http.StatusInternalServerError)
+			return
 		}
 
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(products)
+		json.NewEncoder(w).Encode(p)
 	}
 }
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"server/models"
+	"server/suggest"
+)
+
+const (
+	ftsMatch   = "p.search_vector @@ websearch_to_tsquery('russian', ?)"
+	ftsRank    = "ts_rank(p.search_vector, websearch_to_tsquery('russian', ?))"
+	ftsSnippet = `ts_headline('russian', p.name || '. ' || coalesce(p.description, ''),
+		websearch_to_tsquery('russian', ?),
+		'StartSel=<mark>, StopSel=</mark>, MaxWords=25, MinWords=10, MaxFragments=2')`
+
+	fuzzyMatch   = "(lower(p.name) % lower(?) OR lower(?) <% lower(p.name))"
+	fuzzyRank    = "GREATEST(similarity(lower(p.name), lower(?)), word_similarity(lower(?), lower(p.name)))"
+	fuzzySnippet = "''"
+)
+
+func searchProducts(db *sql.DB, q url.Values, text, match, rank, snippet string) (models.SearchResults, error) {
+	f, _ := parseProductFilter(q)
+	f.add(match, text)
+	param := "$" + strconv.Itoa(len(f.args))
+	order := "rank DESC, p.product_id ASC"
+	if q.Get("sort") != "" {
+		order = f.order
+	}
+
+	res := models.SearchResults{Items: []models.SearchHit{}, Limit: f.limit, Offset: f.offset}
+	if err := db.QueryRow(
+		"SELECT COUNT(*) FROM products p "+f.whereSQL(), f.args...,
+	).Scan(&res.Total); err != nil {
+		return res, err
+	}
+	if res.Total == 0 {
+		return res, nil
+	}
+
+	args := append(f.args, f.limit, f.offset)
+	query := fmt.Sprintf(`
+	SELECT %s, %s AS rank, %s AS snippet
+	%s
+	%s
+	GROUP BY %s
+	ORDER BY %s
+	LIMIT $%d OFFSET $%d
+	`, productColumns,
+		strings.ReplaceAll(rank, "?", param), strings.ReplaceAll(snippet, "?", param),
+		productJoins, f.whereSQL(), productGroupBy, order, len(args)-1, len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return res, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var hit models.SearchHit
+		hit.Product, err = scanProduct(rows, &hit.Rank, &hit.Snippet)
+		if err != nil {
+			return res, err
+		}
+		res.Items = append(res.Items, hit)
+	}
+	return res, rows.Err()
+}
+
+func ProductSearchHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		text := strings.TrimSpace(q.Get("q"))
+		if text == "" || utf8.RuneCountInString(text) > 200 {
+			http.Error(w, "q должен содержать от 1 до 200 символов", http.StatusBadRequest)
+			return
+		}
+		if _, err := parseProductFilter(q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res, err := searchProducts(db, q, text, ftsMatch, ftsRank, ftsSnippet)
+		if err == nil && res.Total == 0 {
+			res, err = searchProducts(db, q, text, fuzzyMatch, fuzzyRank, fuzzySnippet)
+			res.Fuzzy = true
+		}
+		if err != nil {
+			http.Error(w, "Ошибка чтения из БД", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func ProductSuggestHandler(idx *suggest.Index) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+			return
+		}
+		q := r.URL.Query()
+		limit := 10
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 || n > 20 {
+				http.Error(w, "limit должен быть от 1 до 20", http.StatusBadRequest)
+				return
+			}
+			limit = n
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(idx.Suggest(q.Get("q"), limit))
+	}
+}
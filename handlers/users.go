@@ -4,12 +4,42 @@ import (
 	"database/sql"
 	"encoding/json"
 	"net/http"
+	"server/mail"
 	"server/models"
+	"server/usertokens"
+	"server/validators"
 	"strconv"
 	"strings"
 	"time"
 )
 
+func loadUser(db *sql.DB, id int) (models.User, error) {
+	var u models.User
+	var ts sql.NullTime
+	err := db.QueryRow(`
+		SELECT u.user_id, u.first_name, u.last_name, u.email, COALESCE(u.phone, ''), r.role_name,
+		       u.profile_picture_url, u.registration_ts
+		FROM users u
+		JOIN roles r ON r.role_id = u.role_id
+		WHERE u.user_id = $1
+	`, id).Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Phone, &u.Role, &u.ProfilePicture, &ts)
+	u.RegistrationTs = ts.Time.Format(time.RFC3339)
+	return u, err
+}
+
+func writeUser(db *sql.DB, w http.ResponseWriter, id int) {
+	u, err := loadUser(db, id)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Пользователь не найден", http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(u)
+}
+
 func UserHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
@@ -26,23 +56,128 @@ func UserHandler(db *sql.DB) http.HandlerFunc {
 			http.Error(w, "ID должен быть числом", http.StatusBadRequest)
 			return
 		}
-		row := db.QueryRow(`
-			SELECT user_id, first_name, last_name, email, phone, profile_picture_url, registration_ts
-			FROM users
-			WHERE user_id = $1
-		`, id)
-		var u models.User
-		var ts sql.NullTime
-		err = row.Scan(&u.ID, &u.FirstName, &u.LastName, &u.Email, &u.Phone, &u.ProfilePicture, &ts)
-		if err == sql.ErrNoRows {
-			http.Error(w, "Пользователь не найден", http.StatusNotFound)
-			return
-		} else if err != nil {
+		writeUser(db, w, id)
+	}
+}
+
+func validateUserUpdate(req *models.UserUpdate) error {
+	if req.FirstName != nil {
+		if err := validators.ValidateString("first_name", *req.FirstName, 1, 50); err != nil {
+			return err
+		}
+		if err := validators.ValidateName("first_name", *req.FirstName); err != nil {
+			return err
+		}
+	}
+	if req.LastName != nil {
+		if err := validators.ValidateString("last_name", *req.LastName, 1, 50); err != nil {
+			return err
+		}
+		if err := validators.ValidateName("last_name", *req.LastName); err != nil {
+			return err
+		}
+	}
+	if req.Email != nil {
+		if err := validators.ValidateEmail(*req.Email); err != nil {
+			return err
+		}
+	}
+	// An empty phone clears it.
+	if req.Phone != nil && *req.Phone != "" {
+		if err := validators.ValidatePhone(*req.Phone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func MeHandler(db *sql.DB, tokens *usertokens.Issuer, mailer mail.Mailer, baseURL string, getUserID func(*http.Request) int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := getUserID(r)
+		switch r.Method {
+		case http.MethodGet:
+			writeUser(db, w, userID)
+		case http.MethodPatch:
+			updateMe(db, tokens, mailer, baseURL, w, r, userID)
+		default:
+			http.Error(w, "Метод не разрешён", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// updateMe applies name and phone changes at once. A new email only takes
+// effect after the link sent to that address is confirmed.
+func updateMe(db *sql.DB, tokens *usertokens.Issuer, mailer mail.Mailer, baseURL string, w http.ResponseWriter, r *http.Request, userID int) {
+	var req models.UserUpdate
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Неверный формат JSON", http.StatusBadRequest)
+		return
+	}
+	if err := validateUserUpdate(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var currentEmail string
+	var emailTaken bool
+	if err := tx.QueryRow(`
+		SELECT email, EXISTS (SELECT 1 FROM users WHERE email = $2 AND user_id <> $1)
+		FROM users WHERE user_id = $1
+	`, userID, req.Email).Scan(&currentEmail, &emailTaken); err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	newEmail := req.Email
+	if newEmail != nil && *newEmail == currentEmail {
+		newEmail = nil
+	}
+	if newEmail != nil && emailTaken {
+		http.Error(w, "Email или телефон уже заняты", http.StatusConflict)
+		return
+	}
+	_, err = tx.Exec(`
+		UPDATE users
+		SET first_name = COALESCE($1, first_name),
+		    last_name  = COALESCE($2, last_name),
+		    phone      = CASE WHEN $3::text IS NULL THEN phone ELSE NULLIF($3, '') END
+		WHERE user_id = $4
+	`, req.FirstName, req.LastName, req.Phone, userID)
+	if isUniqueViolation(err) {
+		http.Error(w, "Email или телефон уже заняты", http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	var token string
+	if newEmail != nil {
+		if token, err = tokens.Issue(tx, userID, usertokens.ChangeEmail, newEmail); err != nil {
 			http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
 			return
 		}
-		u.RegistrationTs = ts.Time.Format(time.RFC3339)
-		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		json.NewEncoder(w).Encode(u)
 	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+
+	u, err := loadUser(db, userID)
+	if err != nil {
+		http.Error(w, "Ошибка сервера", http.StatusInternalServerError)
+		return
+	}
+	status := http.StatusOK
+	if newEmail != nil {
+		go sendTokenMail(mailer, baseURL, *newEmail, usertokens.ChangeEmail, token)
+		u.PendingEmail = *newEmail
+		status = http.StatusAccepted
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(u)
 }
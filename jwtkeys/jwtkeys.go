@@ -0,0 +1,161 @@
+package jwtkeys
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var ErrUnknownKey = errors.New("jwtkeys: unknown key id")
+
+type key struct {
+	method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+type KeySet struct {
+	active string
+	keys   map[string]key
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// LoadDir reads every <kid>.pem in dir. A file may hold a PKCS#8 private key
+// (RSA or Ed25519) or just the public key of a retired signer, which is still
+// accepted for verification. Tokens are signed with activeKID, which must
+// have a private key.
+func LoadDir(dir, activeKID string) (*KeySet, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	ks := &KeySet{active: activeKID, keys: make(map[string]key)}
+	for _, path := range paths {
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		k, err := parseKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("jwtkeys: %s: %v", kid, err)
+		}
+		ks.keys[kid] = k
+	}
+	if k, ok := ks.keys[activeKID]; !ok || k.private == nil {
+		return nil, fmt.Errorf("jwtkeys: no private key for active kid %q in %s", activeKID, dir)
+	}
+	return ks, nil
+}
+
+func parseKey(data []byte) (key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return key{}, errors.New("no PEM block")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return key{}, err
+		}
+		switch p := priv.(type) {
+		case *rsa.PrivateKey:
+			return key{method: jwt.SigningMethodRS256, private: p, public: &p.PublicKey}, nil
+		case ed25519.PrivateKey:
+			return key{method: jwt.SigningMethodEdDSA, private: p, public: p.Public()}, nil
+		}
+		return key{}, fmt.Errorf("unsupported private key type %T", priv)
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return key{}, err
+		}
+		switch p := pub.(type) {
+		case *rsa.PublicKey:
+			return key{method: jwt.SigningMethodRS256, public: p}, nil
+		case ed25519.PublicKey:
+			return key{method: jwt.SigningMethodEdDSA, public: p}, nil
+		}
+		return key{}, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return key{}, fmt.Errorf("unsupported PEM block %q", block.Type)
+}
+
+// Sign signs claims with the active key. typ goes into the header so that a
+// verifier can tell different kinds of tokens signed with the same keys apart.
+func (ks *KeySet) Sign(typ string, claims jwt.Claims) (string, error) {
+	k := ks.keys[ks.active]
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = ks.active
+	token.Header["typ"] = typ
+	return token.SignedString(k.private)
+}
+
+// Keyfunc picks the verification key by the token's kid and refuses tokens
+// whose alg does not match that key.
+func (ks *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	k, ok := ks.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if t.Method.Alg() != k.method.Alg() {
+		return nil, fmt.Errorf("jwtkeys: key %q does not use %s", kid, t.Method.Alg())
+	}
+	return k.public, nil
+}
+
+func (ks *KeySet) Methods() []string {
+	return []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+}
+
+func (ks *KeySet) JWKS() JWKS {
+	kids := make([]string, 0, len(ks.keys))
+	for kid := range ks.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	set := JWKS{Keys: make([]JWK, 0, len(kids))}
+	for _, kid := range kids {
+		k := ks.keys[kid]
+		jwk := JWK{Kid: kid, Use: "sig", Alg: k.method.Alg()}
+		switch p := k.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(p.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(p)
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
@@ -0,0 +1,180 @@
+package loginguard
+
+import (
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// State is what a Store keeps per key: the number of consecutive failures and
+// when the last one happened.
+type State struct {
+	Failures    int
+	LastFailure time.Time
+}
+
+type Store interface {
+	// Reserve decides an attempt on key under p: if the key is still blocked
+	// at now it returns the wait and changes nothing, otherwise it counts the
+	// attempt as a failure before it is made. The check and the increment are
+	// one atomic step, so parallel attempts cannot all pass on the same count.
+	Reserve(key string, now time.Time, p Policy) (time.Duration, error)
+	// Release takes back one reservation for an attempt that did not fail.
+	Release(key string) error
+	Reset(key string) error
+	Purge(before time.Time) error
+}
+
+type Policy struct {
+	FreeAttempts int
+	BaseDelay    time.Duration
+	MaxDelay     time.Duration
+	LockoutAfter int
+	LockoutFor   time.Duration
+	Window       time.Duration
+}
+
+// delay is how long after the last failure the key stays blocked. The first
+// FreeAttempts failures cost nothing, then the delay doubles with every
+// failure up to MaxDelay, and from LockoutAfter on the key is locked out.
+func (p Policy) delay(failures int) time.Duration {
+	if failures >= p.LockoutAfter {
+		return p.LockoutFor
+	}
+	if failures <= p.FreeAttempts {
+		return 0
+	}
+	d := p.BaseDelay
+	for i := p.FreeAttempts + 1; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	return d
+}
+
+func (p Policy) retryAfter(st State, now time.Time) time.Duration {
+	if st.Failures == 0 || now.Sub(st.LastFailure) > p.Window {
+		return 0
+	}
+	if wait := st.LastFailure.Add(p.delay(st.Failures)).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// reserve is the decision every Store makes while holding the key.
+func (p Policy) reserve(st State, now time.Time) (State, time.Duration) {
+	if wait := p.retryAfter(st, now); wait > 0 {
+		return st, wait
+	}
+	if now.Sub(st.LastFailure) > p.Window {
+		st.Failures = 0
+	}
+	st.Failures++
+	st.LastFailure = now
+	return st, 0
+}
+
+// Guard tracks failed logins per account and per client IP. An IP is allowed
+// more failures than an account since several users may share it; the IP
+// limit can be turned off when every client reaches the server through
+// addresses that cannot be told apart.
+type Guard struct {
+	store   Store
+	proxies Proxies
+	account Policy
+	ip      Policy
+}
+
+// New builds a guard that locks an account out after lockoutAfter failures
+// and an IP after ipLockoutAfter; zero ipLockoutAfter disables the IP limit.
+func New(store Store, proxies Proxies, lockoutAfter int, lockoutFor time.Duration, ipLockoutAfter int) *Guard {
+	account := Policy{
+		FreeAttempts: 3,
+		BaseDelay:    time.Second,
+		MaxDelay:     5 * time.Minute,
+		LockoutAfter: lockoutAfter,
+		LockoutFor:   lockoutFor,
+		Window:       24 * time.Hour,
+	}
+	ip := account
+	ip.FreeAttempts *= 5
+	ip.LockoutAfter = ipLockoutAfter
+	return &Guard{store: store, proxies: proxies, account: account, ip: ip}
+}
+
+func accountKey(email string) string {
+	return "user:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func (g *Guard) limitIP() bool {
+	return g.ip.LockoutAfter > 0
+}
+
+// ClientIP is the address attempts from r are counted against.
+func (g *Guard) ClientIP(r *http.Request) string {
+	return g.proxies.ClientIP(r)
+}
+
+// Attempt reserves an attempt for this account from this IP and returns zero,
+// or returns how long the caller has to wait and reserves nothing. A reserved
+// attempt counts as failed until Succeeded or Release says otherwise.
+func (g *Guard) Attempt(email, ip string) (time.Duration, error) {
+	now := time.Now()
+	wait, err := g.store.Reserve(accountKey(email), now, g.account)
+	if err != nil || wait > 0 || !g.limitIP() {
+		return wait, err
+	}
+	wait, err = g.store.Reserve(ipKey(ip), now, g.ip)
+	if err == nil && wait == 0 {
+		return 0, nil
+	}
+	if rerr := g.store.Release(accountKey(email)); err == nil {
+		err = rerr
+	}
+	return wait, err
+}
+
+// Succeeded clears the account counter and takes back the IP reservation.
+// Earlier IP failures stay so that one valid account cannot be used to reset
+// guessing on others.
+func (g *Guard) Succeeded(email, ip string) error {
+	if err := g.store.Reset(accountKey(email)); err != nil {
+		return err
+	}
+	if !g.limitIP() {
+		return nil
+	}
+	return g.store.Release(ipKey(ip))
+}
+
+// Release takes back a reservation whose attempt neither failed nor fully
+// succeeded, such as a correct password still waiting for a second factor.
+func (g *Guard) Release(email, ip string) error {
+	if err := g.store.Release(accountKey(email)); err != nil {
+		return err
+	}
+	if !g.limitIP() {
+		return nil
+	}
+	return g.store.Release(ipKey(ip))
+}
+
+func (g *Guard) Unlock(email string) error {
+	return g.store.Reset(accountKey(email))
+}
+
+func (g *Guard) PurgeEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := g.store.Purge(time.Now().Add(-g.account.Window)); err != nil {
+			log.Printf("Не удалось очистить счётчики попыток входа: %v", err)
+		}
+	}
+}
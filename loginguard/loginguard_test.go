@@ -0,0 +1,141 @@
+package loginguard
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	FreeAttempts: 3,
+	BaseDelay:    time.Second,
+	MaxDelay:     5 * time.Minute,
+	LockoutAfter: 10,
+	LockoutFor:   30 * time.Minute,
+	Window:       24 * time.Hour,
+}
+
+func TestPolicyDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{3, 0},
+		{4, time.Second},
+		{5, 2 * time.Second},
+		{6, 4 * time.Second},
+		{9, 32 * time.Second},
+		{10, 30 * time.Minute},
+		{50, 30 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := testPolicy.delay(tt.failures); got != tt.want {
+			t.Errorf("delay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+
+	capped := testPolicy
+	capped.MaxDelay = 10 * time.Second
+	capped.LockoutAfter = 100
+	if got := capped.delay(20); got != 10*time.Second {
+		t.Errorf("capped delay(20) = %v, want 10s", got)
+	}
+}
+
+func TestPolicyRetryAfter(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name string
+		st   State
+		want time.Duration
+	}{
+		{"no failures", State{}, 0},
+		{"within free attempts", State{3, now}, 0},
+		{"backing off", State{5, now.Add(-500 * time.Millisecond)}, 1500 * time.Millisecond},
+		{"delay passed", State{5, now.Add(-3 * time.Second)}, 0},
+		{"locked out", State{10, now.Add(-10 * time.Minute)}, 20 * time.Minute},
+		{"outside window", State{10, now.Add(-25 * time.Hour)}, 0},
+	}
+	for _, tt := range tests {
+		if got := testPolicy.retryAfter(tt.st, now); got != tt.want {
+			t.Errorf("%s: retryAfter = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAttemptIsAtomic(t *testing.T) {
+	g := New(NewMemoryStore(), nil, 10, 30*time.Minute, 0)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := g.Attempt("user@example.com", "203.0.113.1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	// Only the free attempts get through a burst; the next one already has
+	// to wait for the first backoff step.
+	if allowed != 4 {
+		t.Errorf("%d of 50 parallel attempts allowed, want 4", allowed)
+	}
+}
+
+func TestSucceededReleasesIP(t *testing.T) {
+	store := NewMemoryStore()
+	g := New(store, nil, 10, 30*time.Minute, 50)
+	for i := 0; i < 20; i++ {
+		if wait, err := g.Attempt("user@example.com", "203.0.113.1"); err != nil || wait != 0 {
+			t.Fatalf("attempt %d: wait %v, err %v", i, wait, err)
+		}
+		if err := g.Succeeded("user@example.com", "203.0.113.1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := store.states[ipKey("203.0.113.1")]; st.Failures != 0 {
+		t.Errorf("IP failures after successful logins = %d, want 0", st.Failures)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	proxies, err := ParseProxies("10.0.0.0/8, 192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"direct", "203.0.113.7:5555", nil, "203.0.113.7"},
+		{"untrusted peer ignores header", "203.0.113.7:5555", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"one proxy", "10.1.2.3:5555", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed left entry", "10.1.2.3:5555", []string{"1.1.1.1, 198.51.100.1"}, "198.51.100.1"},
+		{"proxy chain", "192.0.2.1:443", []string{"198.51.100.1, 10.0.0.5"}, "198.51.100.1"},
+		{"garbage hop", "10.1.2.3:5555", []string{"nonsense"}, "10.1.2.3"},
+		{"no header", "10.1.2.3:5555", nil, "10.1.2.3"},
+	}
+	for _, tt := range tests {
+		r := &http.Request{RemoteAddr: tt.remote, Header: http.Header{}}
+		for _, v := range tt.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		if got := proxies.ClientIP(r); got != tt.want {
+			t.Errorf("%s: ClientIP = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
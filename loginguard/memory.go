@@ -0,0 +1,53 @@
+package loginguard
+
+import (
+	"sync"
+	"time"
+)
+
+// MemoryStore keeps counters in the process. It is enough for a single
+// instance; replicas need PostgresStore to share them.
+type MemoryStore struct {
+	mu     sync.Mutex
+	states map[string]State
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{states: make(map[string]State)}
+}
+
+func (s *MemoryStore) Reserve(key string, now time.Time, p Policy) (time.Duration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, wait := p.reserve(s.states[key], now)
+	s.states[key] = st
+	return wait, nil
+}
+
+func (s *MemoryStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if st, ok := s.states[key]; ok && st.Failures > 0 {
+		st.Failures--
+		s.states[key] = st
+	}
+	return nil
+}
+
+func (s *MemoryStore) Reset(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.states, key)
+	return nil
+}
+
+func (s *MemoryStore) Purge(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, st := range s.states {
+		if st.LastFailure.Before(before) {
+			delete(s.states, key)
+		}
+	}
+	return nil
+}
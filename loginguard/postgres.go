@@ -0,0 +1,68 @@
+package loginguard
+
+import (
+	"database/sql"
+	"time"
+)
+
+type PostgresStore struct {
+	db *sql.DB
+}
+
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+// Reserve holds the key's row lock while it decides, which is what makes the
+// check and the increment atomic across instances.
+func (s *PostgresStore) Reserve(key string, now time.Time, p Policy) (time.Duration, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`
+		INSERT INTO login_attempts (attempt_key, failures, last_failure)
+		VALUES ($1, 0, $2)
+		ON CONFLICT (attempt_key) DO NOTHING
+	`, key, now); err != nil {
+		return 0, err
+	}
+	var st State
+	if err := tx.QueryRow(`
+		SELECT failures, last_failure FROM login_attempts
+		WHERE attempt_key = $1
+		FOR UPDATE
+	`, key).Scan(&st.Failures, &st.LastFailure); err != nil {
+		return 0, err
+	}
+	st, wait := p.reserve(st, now)
+	if wait > 0 {
+		return wait, nil
+	}
+	if _, err := tx.Exec(`
+		UPDATE login_attempts SET failures = $2, last_failure = $3
+		WHERE attempt_key = $1
+	`, key, st.Failures, st.LastFailure); err != nil {
+		return 0, err
+	}
+	return 0, tx.Commit()
+}
+
+func (s *PostgresStore) Release(key string) error {
+	_, err := s.db.Exec(`
+		UPDATE login_attempts SET failures = failures - 1
+		WHERE attempt_key = $1 AND failures > 0
+	`, key)
+	return err
+}
+
+func (s *PostgresStore) Reset(key string) error {
+	_, err := s.db.Exec("DELETE FROM login_attempts WHERE attempt_key = $1", key)
+	return err
+}
+
+func (s *PostgresStore) Purge(before time.Time) error {
+	_, err := s.db.Exec("DELETE FROM login_attempts WHERE last_failure < $1", before)
+	return err
+}
@@ -0,0 +1,79 @@
+package loginguard
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Proxies are the reverse proxies whose X-Forwarded-For header is believed.
+// Without them the client is whoever opened the connection.
+type Proxies []*net.IPNet
+
+// ParseProxies reads a comma-separated list of addresses and CIDR ranges.
+func ParseProxies(spec string) (Proxies, error) {
+	var proxies Proxies
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("loginguard: bad proxy address %q", item)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			proxies = append(proxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, fmt.Errorf("loginguard: bad proxy range %q", item)
+		}
+		proxies = append(proxies, n)
+	}
+	return proxies, nil
+}
+
+func (p Proxies) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range p {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the peer address of r. When the peer is a trusted proxy,
+// X-Forwarded-For is walked from the right, since only the entries appended
+// by our own proxies can be believed, and the first untrusted hop is taken.
+func (p Proxies) ClientIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !p.trusted(addr) {
+		return addr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		addr = hop
+		if !p.trusted(hop) {
+			break
+		}
+	}
+	return addr
+}
@@ -6,19 +6,61 @@ import (
 	"log"
 	"net/http"
 	"strings"
+	"time"
 
-	"github.com/golang-jwt/jwt/v5"
 	_ "github.com/lib/pq"
 
 	"server/config"
 	"server/handlers"
-	"server/models"
+	"server/jwtkeys"
+	"server/loginguard"
+	"server/mail"
+	"server/mfa"
+	"server/payments"
+	"server/sessions"
+	"server/suggest"
+	"server/usertokens"
+	"server/vault"
 )
 
 func main() {
 	cfg := config.LoadConfig()
-	if len(cfg.JWTSecret) == 0 {
-		log.Fatal("JWT_SECRET is not set in environment")
+	jwtKeys, err := jwtkeys.LoadDir(cfg.JWTKeysDir, cfg.JWTActiveKID)
+	if err != nil {
+		log.Fatalf("Не удалось загрузить ключи подписи токенов (JWT_KEYS_DIR): %v", err)
+	}
+
+	cardKeys, err := vault.NewKeyring(cfg.CardKeys, cfg.CardKeyVersion)
+	if err != nil {
+		log.Fatalf("Не удалось загрузить ключи шифрования карт (CARD_KEYS): %v", err)
+	}
+	if len(cfg.CardFingerprintKey) == 0 {
+		log.Fatal("CARD_FINGERPRINT_KEY is not set in environment")
+	}
+	totpKeys, err := vault.NewKeyring(cfg.TOTPKeys, cfg.TOTPKeyVersion)
+	if err != nil {
+		log.Fatalf("Не удалось загрузить ключи шифрования TOTP-секретов (TOTP_KEYS): %v", err)
+	}
+	if len(cfg.RecoveryCodeKey) == 0 {
+		log.Fatal("RECOVERY_CODE_KEY is not set in environment")
+	}
+	if len(cfg.UserTokenKey) == 0 {
+		log.Fatal("USER_TOKEN_KEY is not set in environment")
+	}
+	userTokens := usertokens.NewIssuer(cfg.UserTokenKey)
+
+	var mailer mail.Mailer
+	switch cfg.MailDriver {
+	case "smtp":
+		if mailer, err = mail.NewSMTP(cfg.SMTPAddr, cfg.MailFrom, cfg.SMTPUser, cfg.SMTPPassword); err != nil {
+			log.Fatalf("Не удалось настроить SMTP: %v", err)
+		}
+	case "log":
+		mailer = mail.NewLog(cfg.MailFrom, cfg.MailDir)
+	case "":
+		log.Fatal("MAIL_DRIVER is not set in environment (smtp, or log for local development)")
+	default:
+		log.Fatalf("Неизвестный MAIL_DRIVER %q (ожидается smtp или log)", cfg.MailDriver)
 	}
 
 	db, err := sql.Open("postgres", cfg.DBConnStr)
@@ -32,6 +74,46 @@ func main() {
 	}
 	log.Println("Успешно подключились к БД")
 
+	suggestIndex := suggest.NewIndex(db)
+	if err := suggestIndex.Refresh(); err != nil {
+		log.Fatalf("Не удалось построить индекс подсказок: %v", err)
+	}
+	go suggestIndex.RefreshEvery(5 * time.Minute)
+	catalogChanged := func() {
+		go func() {
+			if err := suggestIndex.Refresh(); err != nil {
+				log.Printf("Не удалось обновить индекс подсказок: %v", err)
+			}
+		}()
+	}
+
+	gateway := payments.NewSimulator()
+	// Payments still unfinished after PAYMENT_TTL, most often waiting for a
+	// 3-D Secure code, are given up and their orders cancelled, so the stock
+	// they hold goes back on sale.
+	go payments.SweepEvery(db, gateway, time.Minute, cfg.PaymentTTL)
+
+	var guardStore loginguard.Store
+	switch cfg.LoginGuardStore {
+	case "postgres":
+		guardStore = loginguard.NewPostgresStore(db)
+	case "memory":
+		guardStore = loginguard.NewMemoryStore()
+	default:
+		log.Fatalf("Неизвестный LOGIN_GUARD_STORE %q (ожидается postgres или memory)", cfg.LoginGuardStore)
+	}
+	trustedProxies, err := loginguard.ParseProxies(cfg.TrustedProxies)
+	if err != nil {
+		log.Fatalf("Неверный TRUSTED_PROXIES: %v", err)
+	}
+	loginGuard := loginguard.New(guardStore, trustedProxies, cfg.LoginLockoutAfter, cfg.LoginLockoutFor, cfg.IPLockoutAfter)
+	go loginGuard.PurgeEvery(time.Hour)
+	go handlers.PurgeIdempotencyKeysEvery(db, time.Hour, cfg.IdempotencyTTL)
+
+	twoFactor := mfa.NewManager(db, totpKeys, cfg.RecoveryCodeKey, cfg.TOTPIssuer)
+
+	sessionManager := sessions.NewManager(db, jwtKeys, cfg.AccessTokenTTL, cfg.RefreshTokenTTL)
+
 	auth := func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
@@ -39,16 +121,17 @@ func main() {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
 			}
-			tokenStr := strings.TrimPrefix(authHeader, "Bearer ")
-			token, err := jwt.ParseWithClaims(tokenStr, &models.Claims{}, func(t *jwt.Token) (interface{}, error) {
-				return cfg.JWTSecret, nil
-			})
-			if err != nil || !token.Valid {
+			claims, err := sessionManager.Authenticate(strings.TrimPrefix(authHeader, "Bearer "))
+			if err == sessions.ErrInvalidToken {
 				http.Error(w, "Unauthorized", http.StatusUnauthorized)
 				return
+			} else if err != nil {
+				http.Error(w, "Server error", http.StatusInternalServerError)
+				return
 			}
-			claims := token.Claims.(*models.Claims)
 			ctx := context.WithValue(r.Context(), "user_id", claims.UserID)
+			ctx = context.WithValue(ctx, "role", claims.Role)
+			ctx = context.WithValue(ctx, "session_id", claims.SessionID)
 			next(w, r.WithContext(ctx))
 		}
 	}
@@ -57,6 +140,20 @@ func main() {
 		return r.Context().Value("user_id").(int)
 	}
 
+	getSessionID := func(r *http.Request) int64 {
+		return r.Context().Value("session_id").(int64)
+	}
+
+	requireRole := func(role string, next http.HandlerFunc) http.HandlerFunc {
+		return auth(func(w http.ResponseWriter, r *http.Request) {
+			if r.Context().Value("role") != role {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+			next(w, r)
+		})
+	}
+
 	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
 		if err := db.Ping(); err != nil {
 			http.Error(w, "db error", http.StatusInternalServerError)
@@ -66,19 +163,44 @@ func main() {
 	})
 
 	http.HandleFunc("/products", handlers.ProductsHandler(db))
-	http.HandleFunc("/users/", handlers.UserHandler(db))
-	http.HandleFunc("/register", handlers.RegisterHandler(db))
-	http.HandleFunc("/login", handlers.LoginHandler(db, cfg.JWTSecret))
+	http.HandleFunc("/products/", handlers.ProductHandler(db))
+	http.HandleFunc("/products/search", handlers.ProductSearchHandler(db))
+	http.HandleFunc("/products/suggest", handlers.ProductSuggestHandler(suggestIndex))
+	http.HandleFunc("/categories", handlers.CategoriesHandler(db))
+	http.HandleFunc("/categories/", handlers.CategoryHandler(db))
+	http.HandleFunc("/users/", requireRole("admin", handlers.UserHandler(db)))
+	http.HandleFunc("/users/me", auth(handlers.MeHandler(db, userTokens, mailer, cfg.AppBaseURL, getUserID)))
+	http.HandleFunc("/users/me/2fa/", auth(handlers.TwoFactorHandler(db, twoFactor, loginGuard, getUserID)))
+	http.HandleFunc("/register", handlers.RegisterHandler(db, userTokens, mailer, cfg.AppBaseURL))
+	http.HandleFunc("/email/confirm", handlers.ConfirmEmailHandler(db, userTokens))
+	http.HandleFunc("/email/resend", handlers.ResendVerificationHandler(db, userTokens, mailer, cfg.AppBaseURL))
+	http.HandleFunc("/login", handlers.LoginHandler(db, sessionManager, loginGuard, twoFactor))
+	http.HandleFunc("/login/mfa", handlers.MFALoginHandler(sessionManager, twoFactor, loginGuard))
+	http.HandleFunc("/.well-known/jwks.json", handlers.JWKSHandler(jwtKeys))
+	http.HandleFunc("/token/refresh", handlers.RefreshTokenHandler(sessionManager))
+	http.HandleFunc("/logout", auth(handlers.LogoutHandler(sessionManager, getSessionID)))
+	http.HandleFunc("/logout/all", auth(handlers.LogoutAllHandler(db, getUserID)))
 
 	http.HandleFunc("/cart", auth(handlers.CartHandler(db, getUserID)))
 	http.HandleFunc("/cart/items", auth(handlers.AddOrUpdateItem(db, getUserID)))
 	http.HandleFunc("/cart/items/", auth(handlers.RemoveItem(db, getUserID)))
 
-	http.HandleFunc("/cards", auth(handlers.CardsHandler(db, getUserID)))
-	http.HandleFunc("/cards/", auth(handlers.DeleteCard(db, getUserID)))
+	http.HandleFunc("/cards", auth(handlers.CardsHandler(db, cardKeys, cfg.CardFingerprintKey, getUserID)))
+	http.HandleFunc("/cards/", auth(handlers.CardHandler(db, getUserID)))
 
-	http.HandleFunc("/checkout", auth(handlers.CheckoutHandler(db, getUserID)))
+	http.HandleFunc("/checkout", auth(handlers.Idempotent(db, getUserID, cfg.IdempotencyTTL, handlers.CheckoutHandler(db, gateway, cardKeys, getUserID))))
 	http.HandleFunc("/orders", auth(handlers.ListOrdersHandler(db, getUserID)))
+	http.HandleFunc("/orders/", auth(handlers.OrderHandler(db, gateway, getUserID)))
+	http.HandleFunc("/payments/", auth(handlers.PaymentHandler(db, gateway, getUserID)))
+	http.HandleFunc("/admin/products", requireRole("admin", handlers.AdminProductsHandler(db, catalogChanged)))
+	http.HandleFunc("/admin/products/", requireRole("admin", handlers.AdminProductHandler(db, catalogChanged)))
+	http.HandleFunc("/admin/categories", requireRole("admin", handlers.AdminCategoriesHandler(db, catalogChanged)))
+	http.HandleFunc("/admin/categories/", requireRole("admin", handlers.AdminCategoryHandler(db, catalogChanged)))
+	http.HandleFunc("/admin/orders/", requireRole("admin", handlers.AdminOrderHandler(db, gateway, getUserID)))
+	http.HandleFunc("/admin/users/", requireRole("admin", handlers.AdminUserHandler(db, loginGuard)))
+
+	http.HandleFunc("/password/forgot", handlers.ForgotPasswordHandler(db, userTokens, mailer, cfg.AppBaseURL))
+	http.HandleFunc("/password/reset", handlers.ResetPasswordHandler(db, userTokens))
 	http.HandleFunc("/users/password", auth(handlers.ChangePasswordHandler(db, getUserID)))
 
 	log.Printf("Сервер запущен на порту %s", cfg.ServerPort)
@@ -0,0 +1,213 @@
+package mfa
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"server/totp"
+	"server/vault"
+)
+
+const recoveryCodeCount = 10
+
+var (
+	ErrAlreadyEnabled = errors.New("two-factor authentication is already enabled")
+	ErrNotEnrolled    = errors.New("two-factor authentication is not enrolled")
+	ErrInvalidCode    = errors.New("invalid code")
+)
+
+// Manager stores TOTP secrets encrypted with the vault keyring and recovery
+// codes as keyed hashes.
+type Manager struct {
+	db      *sql.DB
+	kr      *vault.Keyring
+	codeKey []byte
+	issuer  string
+}
+
+func NewManager(db *sql.DB, kr *vault.Keyring, codeKey []byte, issuer string) *Manager {
+	return &Manager{db: db, kr: kr, codeKey: codeKey, issuer: issuer}
+}
+
+func secretAAD(userID int) []byte {
+	return []byte("user_totp:" + strconv.Itoa(userID))
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func (m *Manager) hashRecoveryCode(code string) string {
+	mac := hmac.New(sha256.New, m.codeKey)
+	mac.Write([]byte(normalizeRecoveryCode(code)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (m *Manager) Enabled(userID int) (bool, error) {
+	var enabled bool
+	err := m.db.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM user_totp WHERE user_id = $1 AND confirmed_at IS NOT NULL)
+	`, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// Enroll creates a new secret for the user, replacing any enrollment that was
+// started but never confirmed. It returns the base32 secret and otpauth URI
+// for the authenticator app.
+func (m *Manager) Enroll(userID int, account string) (string, string, error) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return "", "", err
+	}
+	sealed, version, err := m.kr.Encrypt(secret, secretAAD(userID))
+	if err != nil {
+		return "", "", err
+	}
+	res, err := m.db.Exec(`
+		INSERT INTO user_totp (user_id, secret_enc, key_version)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret_enc = EXCLUDED.secret_enc, key_version = EXCLUDED.key_version,
+		    last_step = 0, created_at = now()
+		WHERE user_totp.confirmed_at IS NULL
+	`, userID, sealed, version)
+	if err != nil {
+		return "", "", err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return "", "", ErrAlreadyEnabled
+	}
+	return totp.EncodeSecret(secret), totp.URI(m.issuer, account, secret), nil
+}
+
+// checkTOTP validates code against the user's secret and remembers the step,
+// so the same code is not accepted twice. It must run inside tx so that the
+// row lock covers the check and the update.
+func (m *Manager) checkTOTP(tx *sql.Tx, userID int, code string, confirmed bool) error {
+	var sealed []byte
+	var version int
+	var lastStep int64
+	var isConfirmed bool
+	err := tx.QueryRow(`
+		SELECT secret_enc, key_version, last_step, confirmed_at IS NOT NULL
+		FROM user_totp WHERE user_id = $1
+		FOR UPDATE
+	`, userID).Scan(&sealed, &version, &lastStep, &isConfirmed)
+	if err == sql.ErrNoRows || (err == nil && isConfirmed != confirmed) {
+		return ErrNotEnrolled
+	} else if err != nil {
+		return err
+	}
+	secret, err := m.kr.Decrypt(sealed, version, secretAAD(userID))
+	if err != nil {
+		return err
+	}
+	step, ok := totp.Validate(secret, strings.TrimSpace(code), time.Now(), lastStep)
+	if !ok {
+		return ErrInvalidCode
+	}
+	_, err = tx.Exec("UPDATE user_totp SET last_step = $1 WHERE user_id = $2", step, userID)
+	return err
+}
+
+// Confirm finishes enrollment with a first valid code and returns fresh
+// recovery codes. They are shown once; only their hashes are kept. Like
+// Disable, it must be rate-limited by the caller.
+func (m *Manager) Confirm(userID int, code string) ([]string, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	if err := m.checkTOTP(tx, userID, code, false); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE user_totp SET confirmed_at = now() WHERE user_id = $1", userID,
+	); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		c := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes[i] = c[:5] + "-" + c[5:]
+		hashes[i] = m.hashRecoveryCode(codes[i])
+	}
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO user_recovery_codes (user_id, code_hash)
+		SELECT $1, unnest($2::text[])
+	`, userID, pq.Array(hashes)); err != nil {
+		return nil, err
+	}
+	return codes, tx.Commit()
+}
+
+// Verify accepts either a current TOTP code or an unused recovery code, which
+// is then spent.
+func (m *Manager) Verify(userID int, code string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.verify(tx, userID, code); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *Manager) verify(tx *sql.Tx, userID int, code string) error {
+	err := m.checkTOTP(tx, userID, code, true)
+	if err != ErrInvalidCode {
+		return err
+	}
+	res, err := tx.Exec(`
+		UPDATE user_recovery_codes SET used_at = now()
+		WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL
+	`, userID, m.hashRecoveryCode(code))
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidCode
+	}
+	return nil
+}
+
+// Disable turns 2FA off after checking a TOTP or recovery code. The check
+// alone does not stop guessing; callers must rate-limit it per account.
+func (m *Manager) Disable(userID int, code string) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.verify(tx, userID, code); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM user_totp WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
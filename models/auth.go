@@ -11,16 +11,69 @@ type Credentials struct {
 }
 
 type Claims struct {
-	UserID int    `json:"user_id"`
-	Email  string `json:"email"`
+	UserID     int    `json:"user_id"`
+	Email      string `json:"email"`
+	Role       string `json:"role"`
+	SessionID  int64  `json:"sid,omitempty"`
+	MFAPending bool   `json:"mfa_pending,omitempty"`
 	jwt.RegisteredClaims
 }
 
+type TokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	UserID       int    `json:"user_id"`
+	Role         string `json:"role"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
 type PasswordChangeRequest struct {
 	OldPassword string `json:"old_password"`
 	NewPassword string `json:"new_password"`
 }
 
 type CheckoutRequest struct {
-	Items []CartRequest `json:"items"`
+	ProductIDs []int `json:"product_ids,omitempty"`
+	CardID     *int  `json:"card_id,omitempty"`
+}
+
+type TokenRequest struct {
+	Token string `json:"token"`
+}
+
+type EmailRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int    `json:"expires_in"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token"`
+	Code     string `json:"code"`
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code"`
+}
+
+type MFAEnrollment struct {
+	Secret     string `json:"secret"`
+	OtpauthURI string `json:"otpauth_uri"`
+}
+
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
 }
@@ -4,7 +4,17 @@ type PaymentCard struct {
 	CardID         int    `json:"card_id"`
 	UserID         int    `json:"user_id"`
 	CardholderName string `json:"cardholder_name"`
-	CardNumber     string `json:"card_number"`
+	CardNumber     string `json:"card_number,omitempty"`
+	Last4          string `json:"last4"`
+	Brand          string `json:"brand"`
 	ExpMonth       int    `json:"exp_month"`
 	ExpYear        int    `json:"exp_year"`
+	IsDefault      bool   `json:"is_default"`
+}
+
+type PaymentCardUpdate struct {
+	CardholderName *string `json:"cardholder_name"`
+	ExpMonth       *int    `json:"exp_month"`
+	ExpYear        *int    `json:"exp_year"`
+	IsDefault      *bool   `json:"is_default"`
 }
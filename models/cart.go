@@ -1,9 +1,10 @@
 package models
 
 type CartItem struct {
-	CartItemID int     `json:"cart_item_id"`
-	Product    Product `json:"product"`
-	Quantity   int     `json:"quantity"`
+	CartItemID   int     `json:"cart_item_id"`
+	Product      Product `json:"product"`
+	Quantity     int     `json:"quantity"`
+	ExceedsStock bool    `json:"exceeds_stock"`
 }
 
 type CartRequest struct {
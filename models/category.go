@@ -0,0 +1,14 @@
+package models
+
+type Category struct {
+	ID           int        `json:"id"`
+	Name         string     `json:"name"`
+	ParentID     *int       `json:"parent_id"`
+	ProductCount int        `json:"product_count"`
+	Children     []Category `json:"children,omitempty"`
+}
+
+type CategoryRequest struct {
+	Name     string `json:"name"`
+	ParentID *int   `json:"parent_id"`
+}
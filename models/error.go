@@ -0,0 +1,14 @@
+package models
+
+type StockError struct {
+	ProductID   int    `json:"product_id"`
+	ProductName string `json:"product_name,omitempty"`
+	Requested   int    `json:"requested"`
+	Available   int    `json:"available"`
+}
+
+type ErrorResponse struct {
+	Error     string       `json:"error"`
+	ProductID int          `json:"product_id,omitempty"`
+	Items     []StockError `json:"items,omitempty"`
+}
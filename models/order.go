@@ -10,11 +10,31 @@ type OrderItem struct {
 }
 
 type OrderSummary struct {
-	OrderID     int         `json:"order_id"`
-	Status      string      `json:"status"`
-	OrderTS     time.Time   `json:"order_ts"`
-	TotalItems  int         `json:"total_items"`
-	TotalAmount string      `json:"total_amount"`
-	UserID      int64       `json:"user_id"`
-	Items       []OrderItem `json:"items"`
+	OrderID     int                 `json:"order_id"`
+	Status      string              `json:"status"`
+	OrderTS     time.Time           `json:"order_ts"`
+	TotalItems  int                 `json:"total_items"`
+	TotalAmount string              `json:"total_amount"`
+	UserID      int64               `json:"user_id"`
+	Items       []OrderItem         `json:"items"`
+	History     []OrderStatusChange `json:"history,omitempty"`
+	Payment     *Payment            `json:"payment,omitempty"`
+}
+
+type OrderStatusChange struct {
+	From      *string   `json:"from"`
+	To        string    `json:"to"`
+	ChangedBy *int      `json:"changed_by"`
+	Comment   *string   `json:"comment,omitempty"`
+	ChangedAt time.Time `json:"changed_at"`
+}
+
+type OrderStatusRequest struct {
+	Status  string `json:"status"`
+	Comment string `json:"comment"`
+}
+
+type OrderList struct {
+	Items      []OrderSummary `json:"items"`
+	NextCursor string         `json:"next_cursor,omitempty"`
 }
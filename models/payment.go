@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+type Payment struct {
+	PaymentID     int       `json:"payment_id"`
+	OrderID       int       `json:"order_id"`
+	CardID        *int      `json:"card_id"`
+	Amount        string    `json:"amount"`
+	Status        string    `json:"status"`
+	FailureReason *string   `json:"failure_reason,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+type PaymentConfirmRequest struct {
+	Code string `json:"code"`
+}
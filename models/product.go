@@ -13,3 +13,41 @@ type Product struct {
 	QuantityInStock int      `json:"quantity_in_stock"`
 	Categories      []string `json:"categories"`
 }
+
+type ProductList struct {
+	Items  []Product `json:"items"`
+	Total  int       `json:"total"`
+	Limit  int       `json:"limit"`
+	Offset int       `json:"offset"`
+}
+
+type ProductRequest struct {
+	Name            string  `json:"name"`
+	Price           float64 `json:"price"`
+	Color           string  `json:"color"`
+	WidthCm         int     `json:"width_cm"`
+	HeightCm        int     `json:"height_cm"`
+	WeightG         int     `json:"weight_g"`
+	ImageURL        *string `json:"image_url,omitempty"`
+	Description     *string `json:"description,omitempty"`
+	QuantityInStock int     `json:"quantity_in_stock"`
+	CategoryIDs     []int   `json:"category_ids"`
+}
+
+type RestockRequest struct {
+	Quantity int `json:"quantity"`
+}
+
+type SearchHit struct {
+	Product
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet,omitempty"`
+}
+
+type SearchResults struct {
+	Items  []SearchHit `json:"items"`
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+	Fuzzy  bool        `json:"fuzzy"`
+}
@@ -0,0 +1,7 @@
+package models
+
+type Suggestion struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+	ID   int    `json:"id"`
+}
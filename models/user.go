@@ -6,6 +6,15 @@ type User struct {
 	LastName       string  `json:"last_name"`
 	Email          string  `json:"email"`
 	Phone          string  `json:"phone"`
+	Role           string  `json:"role"`
+	PendingEmail   string  `json:"pending_email,omitempty"`
 	ProfilePicture *string `json:"profile_picture_url,omitempty"`
 	RegistrationTs string  `json:"registration_ts"`
 }
+
+type UserUpdate struct {
+	FirstName *string `json:"first_name"`
+	LastName  *string `json:"last_name"`
+	Email     *string `json:"email"`
+	Phone     *string `json:"phone"`
+}
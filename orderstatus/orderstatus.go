@@ -0,0 +1,235 @@
+package orderstatus
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"server/models"
+)
+
+const (
+	New        = "Новый"
+	Confirmed  = "Подтверждён"
+	Processing = "В обработке"
+	Shipped    = "Отправлен"
+	Delivered  = "Доставлен"
+	Cancelled  = "Отменён"
+)
+
+var transitions = map[string][]string{
+	New:        {Confirmed, Cancelled},
+	Confirmed:  {Processing, Cancelled},
+	Processing: {Shipped, Cancelled},
+	Shipped:    {Delivered},
+	Delivered:  {},
+	Cancelled:  {},
+}
+
+var customerCancellable = map[string]bool{
+	New:       true,
+	Confirmed: true,
+}
+
+var (
+	ErrOrderNotFound = errors.New("order not found")
+	ErrUnknownStatus = errors.New("unknown order status")
+)
+
+type TransitionError struct {
+	From string
+	To   string
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("transition from %q to %q is not allowed", e.From, e.To)
+}
+
+func Known(status string) bool {
+	_, ok := transitions[status]
+	return ok
+}
+
+func CanTransition(from, to string) bool {
+	for _, s := range transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+func Record(tx *sql.Tx, orderID int, from, to string, actorID int, comment string) error {
+	_, err := tx.Exec(`
+		INSERT INTO order_status_history (order_id, from_status_id, to_status_id, changed_by, comment)
+		VALUES (
+			$1,
+			(SELECT status_id FROM order_statuses WHERE status_name = NULLIF($2, '')),
+			(SELECT status_id FROM order_statuses WHERE status_name = $3),
+			NULLIF($4, 0),
+			NULLIF($5, '')
+		)
+	`, orderID, from, to, actorID, comment)
+	return err
+}
+
+// Transition locks the order row, checks that the move is allowed and writes
+// the history entry. ownerID, when non-zero, restricts the order to that user.
+// Moving an order to Cancelled returns its items to stock.
+func Transition(tx *sql.Tx, orderID, ownerID int, to string, actorID int, comment string) (string, error) {
+	return transition(tx, orderID, ownerID, to, actorID, comment, CanTransition)
+}
+
+// CustomerCancel is Transition to Cancelled, limited to the statuses in which
+// a customer may still cancel their own order.
+func CustomerCancel(tx *sql.Tx, orderID, ownerID int, comment string) (string, error) {
+	return transition(tx, orderID, ownerID, Cancelled, ownerID, comment, func(from, to string) bool {
+		return customerCancellable[from] && CanTransition(from, to)
+	})
+}
+
+func transition(tx *sql.Tx, orderID, ownerID int, to string, actorID int, comment string, allowed func(from, to string) bool) (string, error) {
+	if !Known(to) {
+		return "", ErrUnknownStatus
+	}
+	var from string
+	err := tx.QueryRow(`
+		SELECT os.status_name
+		FROM orders o
+		JOIN order_statuses os ON os.status_id = o.status_id
+		WHERE o.order_id = $1 AND ($2 = 0 OR o.user_id = $2)
+		FOR UPDATE OF o
+	`, orderID, ownerID).Scan(&from)
+	if err == sql.ErrNoRows {
+		return "", ErrOrderNotFound
+	} else if err != nil {
+		return "", err
+	}
+	if !allowed(from, to) {
+		return from, &TransitionError{From: from, To: to}
+	}
+	if _, err := tx.Exec(`
+		UPDATE orders
+		SET status_id = (SELECT status_id FROM order_statuses WHERE status_name = $1)
+		WHERE order_id = $2
+	`, to, orderID); err != nil {
+		return from, err
+	}
+	if to == Cancelled {
+		if err := restock(tx, orderID); err != nil {
+			return from, err
+		}
+	}
+	return from, Record(tx, orderID, from, to, actorID, comment)
+}
+
+// Allocate takes quantity of the product from warehouse stock for one order
+// item, largest stock first, and remembers where it came from so that restock
+// can put it back. Warehouse counts are not kept in step with
+// products.quantity_in_stock, so whatever the warehouses cannot cover is
+// simply left unallocated.
+func Allocate(tx *sql.Tx, orderItemID, productID, quantity int) error {
+	rows, err := tx.Query(`
+		SELECT warehouse_id, quantity
+		FROM warehouse_products
+		WHERE product_id = $1 AND quantity > 0
+		ORDER BY quantity DESC, warehouse_id
+		FOR UPDATE
+	`, productID)
+	if err != nil {
+		return err
+	}
+	type stock struct{ warehouseID, quantity int }
+	var stocks []stock
+	for rows.Next() {
+		var st stock
+		if err := rows.Scan(&st.warehouseID, &st.quantity); err != nil {
+			rows.Close()
+			return err
+		}
+		stocks = append(stocks, st)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, st := range stocks {
+		if quantity == 0 {
+			break
+		}
+		take := min(quantity, st.quantity)
+		if _, err := tx.Exec(`
+			UPDATE warehouse_products SET quantity = quantity - $1
+			WHERE warehouse_id = $2 AND product_id = $3
+		`, take, st.warehouseID, productID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO order_item_allocations (order_item_id, warehouse_id, quantity)
+			VALUES ($1, $2, $3)
+		`, orderItemID, st.warehouseID, take); err != nil {
+			return err
+		}
+		quantity -= take
+	}
+	return nil
+}
+
+func restock(tx *sql.Tx, orderID int) error {
+	if _, err := tx.Exec(`
+		UPDATE products p
+		SET quantity_in_stock = p.quantity_in_stock + oi.quantity
+		FROM (
+			SELECT product_id, SUM(quantity) AS quantity
+			FROM order_items
+			WHERE order_id = $1
+			GROUP BY product_id
+		) oi
+		WHERE p.product_id = oi.product_id
+	`, orderID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`
+		UPDATE warehouse_products wp
+		SET quantity = wp.quantity + a.quantity
+		FROM (
+			SELECT a.warehouse_id, oi.product_id, SUM(a.quantity) AS quantity
+			FROM order_item_allocations a
+			JOIN order_items oi ON oi.order_item_id = a.order_item_id
+			WHERE oi.order_id = $1
+			GROUP BY a.warehouse_id, oi.product_id
+		) a
+		WHERE wp.warehouse_id = a.warehouse_id AND wp.product_id = a.product_id
+	`, orderID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`
+		DELETE FROM order_item_allocations
+		WHERE order_item_id IN (SELECT order_item_id FROM order_items WHERE order_id = $1)
+	`, orderID)
+	return err
+}
+
+func History(db *sql.DB, orderID int) ([]models.OrderStatusChange, error) {
+	rows, err := db.Query(`
+		SELECT fs.status_name, ts.status_name, h.changed_by, h.comment, h.changed_at
+		FROM order_status_history h
+		LEFT JOIN order_statuses fs ON fs.status_id = h.from_status_id
+		JOIN order_statuses ts      ON ts.status_id = h.to_status_id
+		WHERE h.order_id = $1
+		ORDER BY h.changed_at, h.history_id
+	`, orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	history := []models.OrderStatusChange{}
+	for rows.Next() {
+		var c models.OrderStatusChange
+		if err := rows.Scan(&c.From, &c.To, &c.ChangedBy, &c.Comment, &c.ChangedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
+	}
+	return history, rows.Err()
+}
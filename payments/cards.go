@@ -0,0 +1,45 @@
+package payments
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"strconv"
+
+	"server/vault"
+)
+
+func cardAAD(userID int) []byte {
+	return []byte("payment_card:" + strconv.Itoa(userID))
+}
+
+func SealCard(kr *vault.Keyring, userID int, number string) ([]byte, int, error) {
+	return kr.Encrypt([]byte(number), cardAAD(userID))
+}
+
+func OpenCard(kr *vault.Keyring, userID int, sealed []byte, version int) (string, error) {
+	number, err := kr.Decrypt(sealed, version, cardAAD(userID))
+	return string(number), err
+}
+
+// CardFingerprint identifies a card number without storing it: the same
+// number always gives the same fingerprint for a given key.
+func CardFingerprint(key []byte, number string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(number))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// DefaultCard returns the user's default card id, or 0 if they have none.
+func DefaultCard(q queryRower, userID int) (int, error) {
+	var id int
+	err := q.QueryRow(`
+		SELECT card_id FROM payment_cards
+		WHERE user_id = $1 AND is_default
+	`, userID).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return id, err
+}
@@ -0,0 +1,43 @@
+package payments
+
+import "context"
+
+type Status string
+
+const (
+	StatusPending        Status = "pending"
+	StatusAuthorized     Status = "authorized"
+	StatusCaptured       Status = "captured"
+	StatusFailed         Status = "failed"
+	StatusRefunded       Status = "refunded"
+	StatusRequiresAction Status = "requires_action"
+	StatusRefundPending  Status = "refund_pending"
+)
+
+type Card struct {
+	Number   string
+	Holder   string
+	ExpMonth int
+	ExpYear  int
+}
+
+type AuthorizeRequest struct {
+	OrderID int
+	Amount  string
+	Card    Card
+}
+
+type Result struct {
+	Status        Status
+	Reference     string
+	FailureReason string
+}
+
+type Gateway interface {
+	Authorize(ctx context.Context, req AuthorizeRequest) (Result, error)
+	ConfirmChallenge(ctx context.Context, reference, code string) (Result, error)
+	Capture(ctx context.Context, reference string) (Result, error)
+	Refund(ctx context.Context, reference string) (Result, error)
+	// Void releases an authorization that will not be captured.
+	Void(ctx context.Context, reference string) error
+}
@@ -0,0 +1,385 @@
+package payments
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"server/models"
+	"server/orderstatus"
+	"server/vault"
+)
+
+var (
+	ErrCardNotFound    = errors.New("card not found")
+	ErrPaymentNotFound = errors.New("payment not found")
+	ErrNotConfirmable  = errors.New("payment does not require confirmation")
+	ErrPaymentClosed   = errors.New("payment was closed while the gateway was processing it")
+)
+
+type DeclinedError struct {
+	Reason string
+}
+
+func (e *DeclinedError) Error() string {
+	return "payment declined: " + e.Reason
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+const paymentColumns = `
+	payment_id, order_id, card_id, amount::text, status, failure_reason, created_at, updated_at`
+
+func scanPayment(row *sql.Row) (models.Payment, error) {
+	var p models.Payment
+	err := row.Scan(&p.PaymentID, &p.OrderID, &p.CardID, &p.Amount, &p.Status,
+		&p.FailureReason, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+func ForOrder(q queryRower, orderID int) (*models.Payment, error) {
+	p, err := scanPayment(q.QueryRow(`
+		SELECT `+paymentColumns+`
+		FROM payments
+		WHERE order_id = $1
+		ORDER BY payment_id DESC
+		LIMIT 1
+	`, orderID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return &p, err
+}
+
+// gatewayTimeout bounds every gateway call. Payments left pending are only
+// expired after a much longer TTL, so a call in flight is never expired.
+const gatewayTimeout = 30 * time.Second
+
+// Begin records a pending payment for the order with the user's card. It runs
+// in the checkout transaction and talks to no one, so that the order and its
+// payment row are committed before any money moves; Process then does the
+// gateway part.
+func Begin(tx *sql.Tx, orderID, userID, cardID int) (models.Payment, error) {
+	var exists bool
+	if err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM payment_cards WHERE card_id = $1 AND user_id = $2)
+	`, cardID, userID).Scan(&exists); err != nil {
+		return models.Payment{}, err
+	}
+	if !exists {
+		return models.Payment{}, ErrCardNotFound
+	}
+	return scanPayment(tx.QueryRow(`
+		INSERT INTO payments (order_id, card_id, amount, status)
+		SELECT $1, $2, COALESCE(SUM(unit_price * quantity), 0), 'pending'
+		FROM order_items
+		WHERE order_id = $1
+		RETURNING `+paymentColumns, orderID, cardID))
+}
+
+// Process authorizes and captures a payment created by Begin and records the
+// outcome. A declined payment cancels its order and is returned together with
+// a *DeclinedError.
+func Process(ctx context.Context, db *sql.DB, gw Gateway, kr *vault.Keyring, p models.Payment, userID int) (models.Payment, error) {
+	var card Card
+	var sealed []byte
+	var keyVersion int
+	err := db.QueryRow(`
+		SELECT card_number_enc, key_version, cardholder_name, exp_month, exp_year
+		FROM payment_cards
+		WHERE card_id = $1 AND user_id = $2
+	`, p.CardID, userID).Scan(&sealed, &keyVersion, &card.Holder, &card.ExpMonth, &card.ExpYear)
+	if err == sql.ErrNoRows {
+		if _, err := settle(db, gw, p.PaymentID, StatusPending, Result{Status: StatusFailed, FailureReason: "card_not_found"}, userID); err != nil {
+			return models.Payment{}, err
+		}
+		return models.Payment{}, ErrCardNotFound
+	} else if err != nil {
+		return models.Payment{}, err
+	}
+	if card.Number, err = OpenCard(kr, userID, sealed, keyVersion); err != nil {
+		return models.Payment{}, err
+	}
+
+	gctx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+	defer cancel()
+	res, err := gw.Authorize(gctx, AuthorizeRequest{OrderID: p.OrderID, Amount: p.Amount, Card: card})
+	if err != nil {
+		// An authorization we never heard back about is released by the
+		// gateway on its own, so the payment can safely be given up.
+		if _, serr := settle(db, gw, p.PaymentID, StatusPending, Result{Status: StatusFailed, FailureReason: "gateway_error"}, userID); serr != nil {
+			return models.Payment{}, serr
+		}
+		return models.Payment{}, err
+	}
+	return captureAndSettle(gctx, db, gw, p.PaymentID, res, userID)
+}
+
+// Confirm completes a payment waiting for the customer's challenge code. The
+// payment is moved back to pending first, which keeps a second confirmation
+// and the expiry sweep away from it while the gateway is called.
+func Confirm(ctx context.Context, db *sql.DB, gw Gateway, paymentID, userID int, code string) (models.Payment, error) {
+	var ref string
+	err := db.QueryRow(`
+		UPDATE payments p
+		SET status = 'pending', updated_at = now()
+		FROM orders o
+		WHERE p.payment_id = $1 AND o.order_id = p.order_id AND o.user_id = $2
+		  AND p.status = 'requires_action'
+		RETURNING p.gateway_ref
+	`, paymentID, userID).Scan(&ref)
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := db.QueryRow(`
+			SELECT EXISTS (
+				SELECT 1 FROM payments p
+				JOIN orders o ON o.order_id = p.order_id
+				WHERE p.payment_id = $1 AND o.user_id = $2
+			)
+		`, paymentID, userID).Scan(&exists); err != nil {
+			return models.Payment{}, err
+		}
+		if !exists {
+			return models.Payment{}, ErrPaymentNotFound
+		}
+		return models.Payment{}, ErrNotConfirmable
+	} else if err != nil {
+		return models.Payment{}, err
+	}
+
+	gctx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+	defer cancel()
+	res, err := gw.ConfirmChallenge(gctx, ref, code)
+	if err != nil {
+		if _, serr := settle(db, gw, paymentID, StatusPending, Result{Status: StatusRequiresAction}, userID); serr != nil {
+			return models.Payment{}, serr
+		}
+		return models.Payment{}, err
+	}
+	return captureAndSettle(gctx, db, gw, paymentID, res, userID)
+}
+
+func captureAndSettle(ctx context.Context, db *sql.DB, gw Gateway, paymentID int, res Result, actorID int) (models.Payment, error) {
+	if res.Status == StatusAuthorized {
+		captured, err := gw.Capture(ctx, res.Reference)
+		if err != nil {
+			// Nothing would ever retry the capture, so the hold is released
+			// and the order cancelled instead of keeping its stock forever.
+			voidAuthorization(gw, paymentID, res.Reference)
+			failed := Result{Status: StatusFailed, Reference: res.Reference, FailureReason: "capture_failed"}
+			if _, serr := settle(db, gw, paymentID, StatusPending, failed, actorID); serr != nil {
+				return models.Payment{}, serr
+			}
+			return models.Payment{}, err
+		}
+		res = captured
+	}
+	p, err := settle(db, gw, paymentID, StatusPending, res, actorID)
+	if err == nil && res.Status == StatusFailed {
+		err = &DeclinedError{Reason: res.FailureReason}
+	}
+	return p, err
+}
+
+// settle stores a gateway result for a payment that is still in status from,
+// cancelling the order when the payment failed. If the payment was closed in
+// the meantime, money the gateway has just taken is given back.
+func settle(db *sql.DB, gw Gateway, paymentID int, from Status, res Result, actorID int) (models.Payment, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return models.Payment{}, err
+	}
+	defer tx.Rollback()
+	p, err := scanPayment(tx.QueryRow(`
+		UPDATE payments
+		SET status = $1, gateway_ref = COALESCE(NULLIF($2, ''), gateway_ref),
+		    failure_reason = NULLIF($3, ''), updated_at = now()
+		WHERE payment_id = $4 AND status = $5
+		RETURNING `+paymentColumns, string(res.Status), res.Reference, res.FailureReason, paymentID, string(from)))
+	if err == sql.ErrNoRows {
+		if res.Status == StatusCaptured {
+			ctx, cancel := context.WithTimeout(context.Background(), gatewayTimeout)
+			defer cancel()
+			if _, err := gw.Refund(ctx, res.Reference); err != nil {
+				log.Printf("Не удалось вернуть деньги по закрытому платежу %d: %v", paymentID, err)
+			}
+		}
+		return models.Payment{}, ErrPaymentClosed
+	} else if err != nil {
+		return models.Payment{}, err
+	}
+	if res.Status == StatusFailed {
+		if err := cancelOrder(tx, p.OrderID, actorID, "Платёж не прошёл"); err != nil {
+			return models.Payment{}, err
+		}
+	}
+	return p, tx.Commit()
+}
+
+func voidAuthorization(gw Gateway, paymentID int, ref string) {
+	ctx, cancel := context.WithTimeout(context.Background(), gatewayTimeout)
+	defer cancel()
+	if err := gw.Void(ctx, ref); err != nil {
+		log.Printf("Не удалось снять блокировку средств по платежу %d: %v", paymentID, err)
+	}
+}
+
+// cancelOrder cancels the order of a failed payment. An order that has
+// already been cancelled, or moved on by staff, is left as it is.
+func cancelOrder(tx *sql.Tx, orderID, actorID int, comment string) error {
+	_, err := orderstatus.Transition(tx, orderID, 0, orderstatus.Cancelled, actorID, comment)
+	if _, ok := err.(*orderstatus.TransitionError); ok {
+		return nil
+	}
+	return err
+}
+
+// CloseForOrder runs in the transaction that cancels an order. Captured
+// payments are marked for refund and the rest are failed; the refunds
+// themselves are issued by Refund once that transaction has committed.
+func CloseForOrder(tx *sql.Tx, orderID int) error {
+	_, err := tx.Exec(`
+		UPDATE payments
+		SET status = CASE WHEN status = 'captured' THEN 'refund_pending' ELSE 'failed' END,
+		    failure_reason = CASE WHEN status = 'captured' THEN NULL ELSE 'order_cancelled' END,
+		    updated_at = now()
+		WHERE order_id = $1 AND status IN ('pending', 'authorized', 'captured', 'requires_action')
+	`, orderID)
+	return err
+}
+
+// Refund issues the refunds CloseForOrder has marked for the order. A refund
+// that fails stays marked and is retried by the sweep.
+func Refund(ctx context.Context, db *sql.DB, gw Gateway, orderID int) error {
+	return refundWhere(ctx, db, gw, "order_id = $1", orderID)
+}
+
+func refundWhere(ctx context.Context, db *sql.DB, gw Gateway, where string, arg interface{}) error {
+	rows, err := db.Query(`
+		SELECT payment_id, gateway_ref
+		FROM payments
+		WHERE status = 'refund_pending' AND `+where, arg)
+	if err != nil {
+		return err
+	}
+	type pending struct {
+		id  int
+		ref string
+	}
+	var list []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.ref); err != nil {
+			rows.Close()
+			return err
+		}
+		list = append(list, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var firstErr error
+	for _, p := range list {
+		gctx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+		res, err := gw.Refund(gctx, p.ref)
+		cancel()
+		if err == nil {
+			// The gateway refuses to refund a reference twice, so a
+			// concurrent retry of the same refund fails above instead of
+			// paying out again.
+			_, err = db.Exec(`
+				UPDATE payments
+				SET status = $1, failure_reason = NULLIF($2, ''), updated_at = now()
+				WHERE payment_id = $3 AND status = 'refund_pending'
+			`, string(res.Status), res.FailureReason, p.id)
+		}
+		if err != nil {
+			log.Printf("Не удалось вернуть деньги по платежу %d: %v", p.id, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Sweep gives up payments that have waited longer than ttl, either for a 3-D
+// Secure code that never came or unfinished after a crash, cancelling their
+// orders so the reserved stock goes back on sale. It also retries refunds
+// that failed earlier.
+func Sweep(ctx context.Context, db *sql.DB, gw Gateway, ttl time.Duration) error {
+	rows, err := db.Query(`
+		SELECT payment_id FROM payments
+		WHERE status IN ('pending', 'requires_action', 'authorized') AND updated_at < $1
+	`, time.Now().Add(-ttl))
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := expire(db, gw, id, ttl); err != nil {
+			return err
+		}
+	}
+	return refundWhere(ctx, db, gw, "updated_at < $1", time.Now().Add(-time.Minute))
+}
+
+func expire(db *sql.DB, gw Gateway, paymentID int, ttl time.Duration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var orderID int
+	var was Status
+	var ref sql.NullString
+	err = tx.QueryRow(`
+		UPDATE payments p
+		SET status = 'failed', failure_reason = 'expired', updated_at = now()
+		FROM (SELECT payment_id, status FROM payments WHERE payment_id = $1 FOR UPDATE) old
+		WHERE p.payment_id = old.payment_id
+		  AND p.status IN ('pending', 'requires_action', 'authorized') AND p.updated_at < $2
+		RETURNING p.order_id, old.status, p.gateway_ref
+	`, paymentID, time.Now().Add(-ttl)).Scan(&orderID, &was, &ref)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := cancelOrder(tx, orderID, 0, "Платёж не завершён вовремя"); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if was == StatusAuthorized {
+		voidAuthorization(gw, paymentID, ref.String)
+	}
+	return nil
+}
+
+func SweepEvery(db *sql.DB, gw Gateway, interval, ttl time.Duration) {
+	for range time.Tick(interval) {
+		if err := Sweep(context.Background(), db, gw, ttl); err != nil {
+			log.Printf("Не удалось обработать зависшие платежи: %v", err)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package payments
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SimApproveCard           = "4242424242424242"
+	SimDeclineCard           = "4000000000000002"
+	SimInsufficientFundsCard = "4000000000009995"
+	SimChallengeCard         = "4000000000003220"
+	SimChallengeCode         = "123456"
+)
+
+type Simulator struct {
+	mu       sync.Mutex
+	seq      int
+	payments map[string]Status
+	now      func() time.Time
+}
+
+func NewSimulator() *Simulator {
+	return &Simulator{payments: make(map[string]Status), now: time.Now}
+}
+
+func (s *Simulator) Authorize(ctx context.Context, req AuthorizeRequest) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq++
+	res := Result{Reference: fmt.Sprintf("sim_%d_%d", req.OrderID, s.seq)}
+
+	now := s.now()
+	expYear := 2000 + req.Card.ExpYear
+	switch number := strings.ReplaceAll(req.Card.Number, " ", ""); {
+	case expYear < now.Year() || (expYear == now.Year() && req.Card.ExpMonth < int(now.Month())):
+		res.Status, res.FailureReason = StatusFailed, "expired_card"
+	case number == SimDeclineCard:
+		res.Status, res.FailureReason = StatusFailed, "card_declined"
+	case number == SimInsufficientFundsCard:
+		res.Status, res.FailureReason = StatusFailed, "insufficient_funds"
+	case number == SimChallengeCard:
+		res.Status = StatusRequiresAction
+	default:
+		res.Status = StatusAuthorized
+	}
+	s.payments[res.Reference] = res.Status
+	return res, nil
+}
+
+func (s *Simulator) ConfirmChallenge(ctx context.Context, reference, code string) (Result, error) {
+	return s.move(reference, StatusRequiresAction, func() (Status, string) {
+		if code != SimChallengeCode {
+			return StatusFailed, "challenge_failed"
+		}
+		return StatusAuthorized, ""
+	})
+}
+
+func (s *Simulator) Capture(ctx context.Context, reference string) (Result, error) {
+	return s.move(reference, StatusAuthorized, func() (Status, string) { return StatusCaptured, "" })
+}
+
+func (s *Simulator) Refund(ctx context.Context, reference string) (Result, error) {
+	return s.move(reference, StatusCaptured, func() (Status, string) { return StatusRefunded, "" })
+}
+
+func (s *Simulator) Void(ctx context.Context, reference string) error {
+	_, err := s.move(reference, StatusAuthorized, func() (Status, string) { return StatusFailed, "voided" })
+	return err
+}
+
+func (s *Simulator) move(reference string, from Status, next func() (Status, string)) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// References issued before a restart are unknown to this instance and are
+	// assumed to be in the expected state.
+	if current, ok := s.payments[reference]; ok && current != from {
+		return Result{}, fmt.Errorf("simulator: payment %q is %s, expected %s", reference, s.payments[reference], from)
+	}
+	res := Result{Reference: reference}
+	res.Status, res.FailureReason = next()
+	s.payments[reference] = res.Status
+	return res, nil
+}
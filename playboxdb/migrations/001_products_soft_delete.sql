@@ -0,0 +1,9 @@
+-- Мягкое удаление товаров из каталога
+ALTER TABLE products
+    ADD COLUMN deleted_at TIMESTAMPTZ NULL;
+
+-- Название уникально только среди неудалённых товаров, чтобы удалённый товар
+-- можно было создать заново.
+ALTER TABLE products DROP CONSTRAINT products_name_key;
+
+CREATE UNIQUE INDEX products_name_key ON products (name) WHERE deleted_at IS NULL;
@@ -0,0 +1,3 @@
+-- Вложенные категории (например, «Конструкторы» → «LEGO»)
+ALTER TABLE categories
+    ADD COLUMN parent_id INTEGER NULL REFERENCES categories(category_id);
@@ -0,0 +1,11 @@
+-- Полнотекстовый поиск по товарам (русская морфология) и нечёткий поиск по триграммам
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE products
+    ADD COLUMN search_vector TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('russian', coalesce(name, '')), 'A') ||
+        setweight(to_tsvector('russian', coalesce(description, '')), 'B')
+    ) STORED;
+
+CREATE INDEX products_search_idx    ON products USING GIN (search_vector);
+CREATE INDEX products_name_trgm_idx ON products USING GIN (lower(name) gin_trgm_ops);
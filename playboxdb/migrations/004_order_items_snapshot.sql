@@ -0,0 +1,18 @@
+-- Цена и название товара на момент покупки
+BEGIN;
+
+ALTER TABLE order_items
+    ADD COLUMN unit_price   NUMERIC(10,2),
+    ADD COLUMN product_name VARCHAR(150);
+
+UPDATE order_items oi
+SET unit_price   = p.price,
+    product_name = p.name
+FROM products p
+WHERE p.product_id = oi.product_id;
+
+ALTER TABLE order_items
+    ALTER COLUMN unit_price   SET NOT NULL,
+    ALTER COLUMN product_name SET NOT NULL;
+
+COMMIT;
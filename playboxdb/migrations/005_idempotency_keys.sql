@@ -0,0 +1,12 @@
+-- Ключи идемпотентности для повторных запросов оформления заказа
+CREATE TABLE idempotency_keys (
+    user_id         INTEGER      NOT NULL REFERENCES users(user_id),
+    idem_key        VARCHAR(255) NOT NULL,
+    request_hash    CHAR(64)     NOT NULL,
+    status_code     INTEGER      NULL,
+    response_body   BYTEA        NULL,
+    created_at      TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, idem_key)
+);
+
+CREATE INDEX idempotency_keys_created_idx ON idempotency_keys (created_at);
@@ -0,0 +1,20 @@
+-- История смены статусов заказов
+BEGIN;
+
+CREATE TABLE order_status_history (
+    history_id        SERIAL PRIMARY KEY,
+    order_id          INTEGER     NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    from_status_id    INTEGER     NULL REFERENCES order_statuses(status_id),
+    to_status_id      INTEGER     NOT NULL REFERENCES order_statuses(status_id),
+    changed_by        INTEGER     NULL REFERENCES users(user_id),
+    comment           TEXT        NULL,
+    changed_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX order_status_history_order_idx ON order_status_history (order_id, changed_at);
+
+INSERT INTO order_status_history (order_id, from_status_id, to_status_id, changed_by, changed_at)
+SELECT order_id, NULL, status_id, user_id, order_ts
+FROM orders;
+
+COMMIT;
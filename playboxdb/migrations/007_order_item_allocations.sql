@@ -0,0 +1,7 @@
+-- Распределение позиций заказа по складам (для возврата остатков при отмене)
+CREATE TABLE order_item_allocations (
+    order_item_id     INTEGER NOT NULL REFERENCES order_items(order_item_id) ON DELETE CASCADE,
+    warehouse_id      INTEGER NOT NULL REFERENCES warehouses(warehouse_id),
+    quantity          INTEGER NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (order_item_id, warehouse_id)
+);
@@ -0,0 +1,16 @@
+-- Платежи по заказам
+CREATE TABLE payments (
+    payment_id        SERIAL PRIMARY KEY,
+    order_id          INTEGER       NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    card_id           INTEGER       NULL REFERENCES payment_cards(card_id) ON DELETE SET NULL,
+    amount            NUMERIC(10,2) NOT NULL,
+    status            VARCHAR(20)   NOT NULL CHECK (status IN ('pending', 'authorized', 'captured', 'failed', 'refunded', 'requires_action', 'refund_pending')),
+    gateway_ref       VARCHAR(64)   NULL,
+    failure_reason    VARCHAR(100)  NULL,
+    created_at        TIMESTAMPTZ   NOT NULL DEFAULT now(),
+    updated_at        TIMESTAMPTZ   NOT NULL DEFAULT now()
+);
+
+CREATE INDEX payments_order_idx ON payments (order_id);
+CREATE INDEX payments_open_idx ON payments (updated_at)
+    WHERE status IN ('pending', 'authorized', 'requires_action', 'refund_pending');
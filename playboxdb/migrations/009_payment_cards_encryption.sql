@@ -0,0 +1,9 @@
+-- Шифрование номеров карт, шаг 1: новые колонки.
+-- После применения запустите `go run ./cmd/cardkeys`, затем 010_payment_cards_drop_plaintext.sql.
+-- fingerprint на этом шаге не заполняется: колонка появится в 011, после которого утилиту запускают ещё раз.
+ALTER TABLE payment_cards
+    ADD COLUMN card_number_enc BYTEA       NULL,
+    ADD COLUMN key_version     SMALLINT    NULL,
+    ADD COLUMN last4           CHAR(4)     NULL,
+    ADD COLUMN brand           VARCHAR(20) NULL,
+    ALTER COLUMN card_number DROP NOT NULL;
@@ -0,0 +1,13 @@
+-- Шифрование номеров карт, шаг 2: удаление открытых номеров.
+-- Применять только после `go run ./cmd/cardkeys`.
+BEGIN;
+
+ALTER TABLE payment_cards
+    ALTER COLUMN card_number_enc SET NOT NULL,
+    ALTER COLUMN key_version     SET NOT NULL,
+    ALTER COLUMN last4           SET NOT NULL,
+    ALTER COLUMN brand           SET NOT NULL;
+
+ALTER TABLE payment_cards DROP COLUMN card_number;
+
+COMMIT;
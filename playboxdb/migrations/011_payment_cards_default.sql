@@ -0,0 +1,13 @@
+-- Карта по умолчанию и защита от повторного сохранения одной карты.
+-- После применения запустите `go run ./cmd/cardkeys` ещё раз (первый запуск был после 009),
+-- чтобы заполнить fingerprint у существующих карт;
+-- повторно сохранённые карты остаются без fingerprint и перечисляются в логе.
+ALTER TABLE payment_cards
+    ADD COLUMN fingerprint CHAR(64) NULL,
+    ADD COLUMN is_default  BOOLEAN  NOT NULL DEFAULT false,
+    ADD CONSTRAINT payment_cards_user_fingerprint_key UNIQUE (user_id, fingerprint);
+
+UPDATE payment_cards SET is_default = true
+WHERE card_id IN (SELECT MIN(card_id) FROM payment_cards GROUP BY user_id);
+
+CREATE UNIQUE INDEX payment_cards_default_idx ON payment_cards (user_id) WHERE is_default;
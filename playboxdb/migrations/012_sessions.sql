@@ -0,0 +1,20 @@
+-- Сессии пользователей и ротируемые refresh-токены
+CREATE TABLE sessions (
+    session_id      BIGSERIAL    PRIMARY KEY,
+    user_id         INTEGER      NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    created_at      TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    last_used_at    TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    revoked_at      TIMESTAMPTZ  NULL
+);
+
+CREATE INDEX sessions_user_idx ON sessions (user_id) WHERE revoked_at IS NULL;
+
+CREATE TABLE refresh_tokens (
+    token_hash      CHAR(64)     PRIMARY KEY,
+    session_id      BIGINT       NOT NULL REFERENCES sessions(session_id) ON DELETE CASCADE,
+    created_at      TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    expires_at      TIMESTAMPTZ  NOT NULL,
+    used_at         TIMESTAMPTZ  NULL
+);
+
+CREATE INDEX refresh_tokens_session_idx ON refresh_tokens (session_id);
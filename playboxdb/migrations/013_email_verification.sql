@@ -0,0 +1,17 @@
+-- Подтверждение email: отметка о подтверждении и одноразовые токены из писем.
+-- Уже зарегистрированные пользователи считаются подтверждёнными.
+ALTER TABLE users ADD COLUMN email_verified_at TIMESTAMPTZ NULL;
+
+UPDATE users SET email_verified_at = registration_ts;
+
+CREATE TABLE user_tokens (
+    token_hash      CHAR(64)     PRIMARY KEY,
+    user_id         INTEGER      NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    purpose         VARCHAR(20)  NOT NULL CONSTRAINT user_tokens_purpose_check CHECK (purpose IN ('verify_email', 'change_email')),
+    new_email       VARCHAR(150) NULL,
+    created_at      TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    expires_at      TIMESTAMPTZ  NOT NULL,
+    used_at         TIMESTAMPTZ  NULL
+);
+
+CREATE INDEX user_tokens_user_idx ON user_tokens (user_id, purpose) WHERE used_at IS NULL;
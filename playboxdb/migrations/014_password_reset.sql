@@ -0,0 +1,5 @@
+-- Токены восстановления пароля хранятся в user_tokens.
+ALTER TABLE user_tokens DROP CONSTRAINT user_tokens_purpose_check;
+
+ALTER TABLE user_tokens ADD CONSTRAINT user_tokens_purpose_check
+    CHECK (purpose IN ('verify_email', 'change_email', 'reset_password'));
@@ -0,0 +1,8 @@
+-- Счётчики неудачных попыток входа для защиты от перебора паролей
+CREATE TABLE login_attempts (
+    attempt_key     VARCHAR(200) PRIMARY KEY,
+    failures        INTEGER      NOT NULL,
+    last_failure    TIMESTAMPTZ  NOT NULL
+);
+
+CREATE INDEX login_attempts_last_failure_idx ON login_attempts (last_failure);
@@ -0,0 +1,17 @@
+-- Двухфакторная аутентификация: зашифрованные TOTP-секреты и одноразовые коды восстановления
+CREATE TABLE user_totp (
+    user_id         INTEGER      PRIMARY KEY REFERENCES users(user_id) ON DELETE CASCADE,
+    secret_enc      BYTEA        NOT NULL,
+    key_version     SMALLINT     NOT NULL,
+    last_step       BIGINT       NOT NULL DEFAULT 0,
+    created_at      TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    confirmed_at    TIMESTAMPTZ  NULL
+);
+
+CREATE TABLE user_recovery_codes (
+    code_id         SERIAL       PRIMARY KEY,
+    user_id         INTEGER      NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    code_hash       CHAR(64)     NOT NULL,
+    used_at         TIMESTAMPTZ  NULL,
+    UNIQUE (user_id, code_hash)
+);
@@ -0,0 +1,4 @@
+-- Телефон необязателен: пустое значение хранится как NULL, чтобы не нарушать UNIQUE.
+ALTER TABLE users ALTER COLUMN phone DROP NOT NULL;
+
+UPDATE users SET phone = NULL WHERE phone = '';
@@ -1,3 +1,6 @@
+-- 0. Расширения
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
 -- 1. Справочники / родительские таблицы
 
 -- 1.1 Роли пользователей
@@ -9,7 +12,8 @@ CREATE TABLE roles (
 -- 1.2 Категории товаров
 CREATE TABLE categories (
     category_id       SERIAL PRIMARY KEY,
-    name              VARCHAR(100) UNIQUE NOT NULL
+    name              VARCHAR(100) UNIQUE NOT NULL,
+    parent_id         INTEGER NULL REFERENCES categories(category_id)
 );
 
 -- 1.3 Статусы заказов
@@ -33,16 +37,17 @@ CREATE TABLE users (
     first_name          VARCHAR(50)   NOT NULL,
     last_name           VARCHAR(50)   NOT NULL,
     email               VARCHAR(150)  UNIQUE NOT NULL,
-    phone               VARCHAR(20)   UNIQUE NOT NULL,
+    phone               VARCHAR(20)   UNIQUE NULL,
     password_hash       VARCHAR(256)  NOT NULL,
     profile_picture_url TEXT          NULL,
-    registration_ts     TIMESTAMPTZ   NOT NULL DEFAULT now()
+    registration_ts     TIMESTAMPTZ   NOT NULL DEFAULT now(),
+    email_verified_at   TIMESTAMPTZ   NULL
 );
 
 -- 2.2 Товары
 CREATE TABLE products (
     product_id        SERIAL PRIMARY KEY,
-    name              VARCHAR(150)  UNIQUE NOT NULL,
+    name              VARCHAR(150)  NOT NULL,
     price             NUMERIC(10,2) NOT NULL,
     color             VARCHAR(50)   NOT NULL,
     width_cm          INTEGER       NOT NULL CHECK (width_cm > 0),
@@ -50,9 +55,18 @@ CREATE TABLE products (
     weight_g          INTEGER       NOT NULL CHECK (weight_g > 0),
     description       TEXT          NULL,
     image_url         TEXT,
-    quantity_in_stock INTEGER       NOT NULL CHECK (quantity_in_stock >= 0)
+    quantity_in_stock INTEGER       NOT NULL CHECK (quantity_in_stock >= 0),
+    deleted_at        TIMESTAMPTZ   NULL,
+    search_vector     TSVECTOR GENERATED ALWAYS AS (
+        setweight(to_tsvector('russian', coalesce(name, '')), 'A') ||
+        setweight(to_tsvector('russian', coalesce(description, '')), 'B')
+    ) STORED
 );
 
+CREATE UNIQUE INDEX products_name_key  ON products (name) WHERE deleted_at IS NULL;
+CREATE INDEX products_search_idx    ON products USING GIN (search_vector);
+CREATE INDEX products_name_trgm_idx ON products USING GIN (lower(name) gin_trgm_ops);
+
 -- 2.3 Склады
 CREATE TABLE warehouses (
     warehouse_id      SERIAL PRIMARY KEY,
@@ -115,19 +129,57 @@ CREATE TABLE order_items (
     order_item_id     SERIAL PRIMARY KEY,
     order_id          INTEGER NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
     product_id        INTEGER NOT NULL REFERENCES products(product_id),
-    quantity          INTEGER NOT NULL CHECK (quantity > 0)
+    quantity          INTEGER NOT NULL CHECK (quantity > 0),
+    unit_price        NUMERIC(10,2) NOT NULL,
+    product_name      VARCHAR(150)  NOT NULL
 );
 
+CREATE TABLE order_status_history (
+    history_id        SERIAL PRIMARY KEY,
+    order_id          INTEGER     NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    from_status_id    INTEGER     NULL REFERENCES order_statuses(status_id),
+    to_status_id      INTEGER     NOT NULL REFERENCES order_statuses(status_id),
+    changed_by        INTEGER     NULL REFERENCES users(user_id),
+    comment           TEXT        NULL,
+    changed_at        TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE INDEX order_status_history_order_idx ON order_status_history (order_id, changed_at);
+
 -- 3.4 Платёжные карты
 CREATE TABLE payment_cards (
     card_id         SERIAL PRIMARY KEY,
     user_id         INTEGER     NOT NULL REFERENCES users(user_id),
     cardholder_name VARCHAR(100) NOT NULL,
-    card_number     VARCHAR(19)  NOT NULL,
+    card_number_enc BYTEA       NOT NULL,
+    key_version     SMALLINT    NOT NULL,
+    last4           CHAR(4)     NOT NULL,
+    brand           VARCHAR(20) NOT NULL,
     exp_month       SMALLINT    NOT NULL CHECK (exp_month BETWEEN 1 AND 12),
-    exp_year        SMALLINT    NOT NULL
+    exp_year        SMALLINT    NOT NULL,
+    fingerprint     CHAR(64)    NULL,
+    is_default      BOOLEAN     NOT NULL DEFAULT false,
+    CONSTRAINT payment_cards_user_fingerprint_key UNIQUE (user_id, fingerprint)
 );
 
+CREATE UNIQUE INDEX payment_cards_default_idx ON payment_cards (user_id) WHERE is_default;
+
+CREATE TABLE payments (
+    payment_id        SERIAL PRIMARY KEY,
+    order_id          INTEGER       NOT NULL REFERENCES orders(order_id) ON DELETE CASCADE,
+    card_id           INTEGER       NULL REFERENCES payment_cards(card_id) ON DELETE SET NULL,
+    amount            NUMERIC(10,2) NOT NULL,
+    status            VARCHAR(20)   NOT NULL CHECK (status IN ('pending', 'authorized', 'captured', 'failed', 'refunded', 'requires_action', 'refund_pending')),
+    gateway_ref       VARCHAR(64)   NULL,
+    failure_reason    VARCHAR(100)  NULL,
+    created_at        TIMESTAMPTZ   NOT NULL DEFAULT now(),
+    updated_at        TIMESTAMPTZ   NOT NULL DEFAULT now()
+);
+
+CREATE INDEX payments_order_idx ON payments (order_id);
+CREATE INDEX payments_open_idx ON payments (updated_at)
+    WHERE status IN ('pending', 'authorized', 'requires_action', 'refund_pending');
+
 -- 3.5 Запасы на складах
 CREATE TABLE warehouse_products (
     warehouse_id      INTEGER NOT NULL REFERENCES warehouses(warehouse_id),
@@ -136,6 +188,13 @@ CREATE TABLE warehouse_products (
     PRIMARY KEY (warehouse_id, product_id)
 );
 
+CREATE TABLE order_item_allocations (
+    order_item_id     INTEGER NOT NULL REFERENCES order_items(order_item_id) ON DELETE CASCADE,
+    warehouse_id      INTEGER NOT NULL REFERENCES warehouses(warehouse_id),
+    quantity          INTEGER NOT NULL CHECK (quantity > 0),
+    PRIMARY KEY (order_item_id, warehouse_id)
+);
+
 -- 3.6 Связь персонал ↔ линии
 CREATE TABLE staff_worklines (
     staff_id          INTEGER NOT NULL REFERENCES staff(staff_id),
@@ -144,6 +203,80 @@ CREATE TABLE staff_worklines (
 );
 
 
+-- 3.7 Ключи идемпотентности
+CREATE TABLE idempotency_keys (
+    user_id         INTEGER      NOT NULL REFERENCES users(user_id),
+    idem_key        VARCHAR(255) NOT NULL,
+    request_hash    CHAR(64)     NOT NULL,
+    status_code     INTEGER      NULL,
+    response_body   BYTEA        NULL,
+    created_at      TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    PRIMARY KEY (user_id, idem_key)
+);
+
+CREATE INDEX idempotency_keys_created_idx ON idempotency_keys (created_at);
+
+-- 3.8 Сессии и refresh-токены
+CREATE TABLE sessions (
+    session_id      BIGSERIAL    PRIMARY KEY,
+    user_id         INTEGER      NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    created_at      TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    last_used_at    TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    revoked_at      TIMESTAMPTZ  NULL
+);
+
+CREATE INDEX sessions_user_idx ON sessions (user_id) WHERE revoked_at IS NULL;
+
+CREATE TABLE refresh_tokens (
+    token_hash      CHAR(64)     PRIMARY KEY,
+    session_id      BIGINT       NOT NULL REFERENCES sessions(session_id) ON DELETE CASCADE,
+    created_at      TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    expires_at      TIMESTAMPTZ  NOT NULL,
+    used_at         TIMESTAMPTZ  NULL
+);
+
+CREATE INDEX refresh_tokens_session_idx ON refresh_tokens (session_id);
+
+-- 3.9 Одноразовые токены из писем
+CREATE TABLE user_tokens (
+    token_hash      CHAR(64)     PRIMARY KEY,
+    user_id         INTEGER      NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    purpose         VARCHAR(20)  NOT NULL CONSTRAINT user_tokens_purpose_check CHECK (purpose IN ('verify_email', 'change_email', 'reset_password')),
+    new_email       VARCHAR(150) NULL,
+    created_at      TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    expires_at      TIMESTAMPTZ  NOT NULL,
+    used_at         TIMESTAMPTZ  NULL
+);
+
+CREATE INDEX user_tokens_user_idx ON user_tokens (user_id, purpose) WHERE used_at IS NULL;
+
+-- 3.10 Неудачные попытки входа (ключ: user:<email> или ip:<адрес>)
+CREATE TABLE login_attempts (
+    attempt_key     VARCHAR(200) PRIMARY KEY,
+    failures        INTEGER      NOT NULL,
+    last_failure    TIMESTAMPTZ  NOT NULL
+);
+
+CREATE INDEX login_attempts_last_failure_idx ON login_attempts (last_failure);
+
+-- 3.11 Двухфакторная аутентификация (TOTP) и коды восстановления
+CREATE TABLE user_totp (
+    user_id         INTEGER      PRIMARY KEY REFERENCES users(user_id) ON DELETE CASCADE,
+    secret_enc      BYTEA        NOT NULL,
+    key_version     SMALLINT     NOT NULL,
+    last_step       BIGINT       NOT NULL DEFAULT 0,
+    created_at      TIMESTAMPTZ  NOT NULL DEFAULT now(),
+    confirmed_at    TIMESTAMPTZ  NULL
+);
+
+CREATE TABLE user_recovery_codes (
+    code_id         SERIAL       PRIMARY KEY,
+    user_id         INTEGER      NOT NULL REFERENCES users(user_id) ON DELETE CASCADE,
+    code_hash       CHAR(64)     NOT NULL,
+    used_at         TIMESTAMPTZ  NULL,
+    UNIQUE (user_id, code_hash)
+);
+
 -- 4. Заполнение справочных таблиц
 
 -- 4.1 Роли
@@ -0,0 +1,282 @@
+package sessions
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"server/jwtkeys"
+	"server/models"
+)
+
+const mfaTokenTTL = 5 * time.Minute
+
+// Access tokens and the tokens of the MFA step are signed with the same keys,
+// so each kind carries its own audience and typ header and is only accepted
+// where that kind is expected.
+const (
+	AccessAudience = "playbox-api"
+	AccessType     = "at+jwt"
+	mfaAudience    = "playbox-mfa"
+	mfaType        = "mfa+jwt"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid or expired token")
+	ErrTokenReused  = errors.New("refresh token reused, session revoked")
+)
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Manager issues short-lived access tokens bound to a server-side session and
+// rotates the refresh tokens that keep the session alive.
+type Manager struct {
+	db         *sql.DB
+	keys       *jwtkeys.KeySet
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+func NewManager(db *sql.DB, keys *jwtkeys.KeySet, accessTTL, refreshTTL time.Duration) *Manager {
+	return &Manager{db: db, keys: keys, accessTTL: accessTTL, refreshTTL: refreshTTL}
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRefreshToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (m *Manager) storeRefreshToken(tx *sql.Tx, sessionID int64) (string, error) {
+	token, err := newRefreshToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(`
+		INSERT INTO refresh_tokens (token_hash, session_id, expires_at)
+		VALUES ($1, $2, $3)
+	`, hashToken(token), sessionID, time.Now().Add(m.refreshTTL))
+	return token, err
+}
+
+func (m *Manager) signAccessToken(userID int, email, role string, sessionID int64) (string, error) {
+	now := time.Now()
+	claims := &models.Claims{
+		UserID:    userID,
+		Email:     email,
+		Role:      role,
+		SessionID: sessionID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{AccessAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(m.accessTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	}
+	return m.keys.Sign(AccessType, claims)
+}
+
+func (m *Manager) pair(userID int, email, role string, sessionID int64, refresh string) (models.TokenPair, error) {
+	access, err := m.signAccessToken(userID, email, role, sessionID)
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	return models.TokenPair{
+		Token:        access,
+		RefreshToken: refresh,
+		ExpiresIn:    int(m.accessTTL.Seconds()),
+		UserID:       userID,
+		Role:         role,
+	}, nil
+}
+
+// Start opens a new session for a user who has just proven their identity.
+func (m *Manager) Start(userID int, email, role string) (models.TokenPair, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	defer tx.Rollback()
+	var sessionID int64
+	if err := tx.QueryRow(
+		"INSERT INTO sessions (user_id) VALUES ($1) RETURNING session_id", userID,
+	).Scan(&sessionID); err != nil {
+		return models.TokenPair{}, err
+	}
+	refresh, err := m.storeRefreshToken(tx, sessionID)
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return models.TokenPair{}, err
+	}
+	return m.pair(userID, email, role, sessionID, refresh)
+}
+
+// Refresh exchanges a refresh token for a new pair. Each refresh token works
+// once; presenting one that was already used revokes the whole session, since
+// it means the token has leaked.
+func (m *Manager) Refresh(token string) (models.TokenPair, error) {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	defer tx.Rollback()
+	var (
+		sessionID   int64
+		userID      int
+		email, role string
+		expiresAt   time.Time
+		used        bool
+		revoked     bool
+	)
+	err = tx.QueryRow(`
+		SELECT s.session_id, u.user_id, u.email, r.role_name,
+		       t.expires_at, t.used_at IS NOT NULL, s.revoked_at IS NOT NULL
+		FROM refresh_tokens t
+		JOIN sessions s ON s.session_id = t.session_id
+		JOIN users u    ON u.user_id = s.user_id
+		JOIN roles r    ON r.role_id = u.role_id
+		WHERE t.token_hash = $1
+		FOR UPDATE OF t, s
+	`, hashToken(token)).Scan(&sessionID, &userID, &email, &role, &expiresAt, &used, &revoked)
+	if err == sql.ErrNoRows {
+		return models.TokenPair{}, ErrInvalidToken
+	} else if err != nil {
+		return models.TokenPair{}, err
+	}
+	if revoked {
+		return models.TokenPair{}, ErrInvalidToken
+	}
+	if used {
+		if err := revoke(tx, "session_id = $1", sessionID); err != nil {
+			return models.TokenPair{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return models.TokenPair{}, err
+		}
+		return models.TokenPair{}, ErrTokenReused
+	}
+	if time.Now().After(expiresAt) {
+		return models.TokenPair{}, ErrInvalidToken
+	}
+	if _, err := tx.Exec(
+		"UPDATE refresh_tokens SET used_at = now() WHERE token_hash = $1", hashToken(token),
+	); err != nil {
+		return models.TokenPair{}, err
+	}
+	if _, err := tx.Exec(
+		"UPDATE sessions SET last_used_at = now() WHERE session_id = $1", sessionID,
+	); err != nil {
+		return models.TokenPair{}, err
+	}
+	refresh, err := m.storeRefreshToken(tx, sessionID)
+	if err != nil {
+		return models.TokenPair{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return models.TokenPair{}, err
+	}
+	return m.pair(userID, email, role, sessionID, refresh)
+}
+
+func (m *Manager) parse(tokenStr, audience, typ string) (*models.Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenStr, &models.Claims{}, m.keys.Keyfunc,
+		jwt.WithValidMethods(m.keys.Methods()), jwt.WithAudience(audience))
+	if err != nil || !token.Valid || token.Header["typ"] != typ {
+		return nil, ErrInvalidToken
+	}
+	return token.Claims.(*models.Claims), nil
+}
+
+// Authenticate checks the access token signature, expiry and audience and
+// that its session has not been revoked. Tokens still waiting for a second
+// factor are refused.
+func (m *Manager) Authenticate(tokenStr string) (*models.Claims, error) {
+	claims, err := m.parse(tokenStr, AccessAudience, AccessType)
+	if err != nil {
+		return nil, err
+	}
+	if claims.MFAPending {
+		return nil, ErrInvalidToken
+	}
+	var active bool
+	err = m.db.QueryRow(`
+		SELECT revoked_at IS NULL FROM sessions
+		WHERE session_id = $1 AND user_id = $2
+	`, claims.SessionID, claims.UserID).Scan(&active)
+	if err == sql.ErrNoRows || (err == nil && !active) {
+		return nil, ErrInvalidToken
+	} else if err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// StartMFA issues the short-lived token a user gets after the password step
+// when two-factor authentication is on. It opens no session and is only
+// accepted by ParseMFA.
+func (m *Manager) StartMFA(userID int, email, role string) (models.MFAChallenge, error) {
+	now := time.Now()
+	token, err := m.keys.Sign(mfaType, &models.Claims{
+		UserID:     userID,
+		Email:      email,
+		Role:       role,
+		MFAPending: true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Audience:  jwt.ClaimStrings{mfaAudience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(mfaTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+	})
+	if err != nil {
+		return models.MFAChallenge{}, err
+	}
+	return models.MFAChallenge{
+		MFARequired: true,
+		MFAToken:    token,
+		ExpiresIn:   int(mfaTokenTTL.Seconds()),
+	}, nil
+}
+
+func (m *Manager) ParseMFA(tokenStr string) (*models.Claims, error) {
+	claims, err := m.parse(tokenStr, mfaAudience, mfaType)
+	if err != nil {
+		return nil, err
+	}
+	if !claims.MFAPending {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+func revoke(q execer, where string, arg interface{}) error {
+	_, err := q.Exec(`
+		UPDATE sessions SET revoked_at = now()
+		WHERE revoked_at IS NULL AND `+where, arg)
+	return err
+}
+
+func (m *Manager) Revoke(sessionID int64) error {
+	return revoke(m.db, "session_id = $1", sessionID)
+}
+
+// RevokeAll ends every session of the user. q may be a transaction so that
+// the revocation commits together with the change that requires it.
+func RevokeAll(q execer, userID int) error {
+	return revoke(q, "user_id = $1", userID)
+}
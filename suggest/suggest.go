@@ -0,0 +1,135 @@
+package suggest
+
+import (
+	"database/sql"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"server/models"
+)
+
+type entry struct {
+	key  string
+	word int
+	item models.Suggestion
+}
+
+type Index struct {
+	db      *sql.DB
+	mu      sync.RWMutex
+	entries []entry
+}
+
+func NewIndex(db *sql.DB) *Index {
+	return &Index{db: db}
+}
+
+func normalize(s string) string {
+	return strings.ReplaceAll(strings.ToLower(s), "ё", "е")
+}
+
+func wordStarts(s string) []int {
+	var starts []int
+	prevLetter := false
+	for i, r := range s {
+		isLetter := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isLetter && !prevLetter {
+			starts = append(starts, i)
+		}
+		prevLetter = isLetter
+	}
+	return starts
+}
+
+func (idx *Index) Refresh() error {
+	rows, err := idx.db.Query(`
+		SELECT product_id, name, 'product' FROM products WHERE deleted_at IS NULL
+		UNION ALL
+		SELECT category_id, name, 'category' FROM categories
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var entries []entry
+	for rows.Next() {
+		var it models.Suggestion
+		if err := rows.Scan(&it.ID, &it.Text, &it.Type); err != nil {
+			return err
+		}
+		norm := normalize(it.Text)
+		for n, start := range wordStarts(norm) {
+			entries = append(entries, entry{key: norm[start:], word: n, item: it})
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	idx.mu.Lock()
+	idx.entries = entries
+	idx.mu.Unlock()
+	return nil
+}
+
+func (idx *Index) RefreshEvery(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := idx.Refresh(); err != nil {
+			log.Printf("Не удалось обновить индекс подсказок: %v", err)
+		}
+	}
+}
+
+func (idx *Index) Suggest(prefix string, limit int) []models.Suggestion {
+	prefix = normalize(strings.TrimSpace(prefix))
+	result := []models.Suggestion{}
+	if prefix == "" {
+		return result
+	}
+
+	idx.mu.RLock()
+	entries := idx.entries
+	idx.mu.RUnlock()
+
+	type match struct {
+		word int
+		item models.Suggestion
+	}
+	seen := make(map[models.Suggestion]int)
+	var matches []match
+	for i := sort.Search(len(entries), func(i int) bool { return entries[i].key >= prefix }); i < len(entries); i++ {
+		e := entries[i]
+		if !strings.HasPrefix(e.key, prefix) {
+			break
+		}
+		if j, ok := seen[e.item]; ok {
+			if e.word < matches[j].word {
+				matches[j].word = e.word
+			}
+			continue
+		}
+		seen[e.item] = len(matches)
+		matches = append(matches, match{e.word, e.item})
+	}
+
+	sort.SliceStable(matches, func(i, j int) bool {
+		a, b := matches[i], matches[j]
+		if (a.word == 0) != (b.word == 0) {
+			return a.word == 0
+		}
+		if a.item.Type != b.item.Type {
+			return a.item.Type == "category"
+		}
+		return len(a.item.Text) < len(b.item.Text)
+	})
+	for i := 0; i < len(matches) && i < limit; i++ {
+		result = append(result, matches[i].item)
+	}
+	return result
+}
@@ -0,0 +1,55 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 6238, appendix B (SHA-1), truncated to six digits.
+var rfcSecret = []byte("12345678901234567890")
+
+func TestCodeRFC6238(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		if got := Code(rfcSecret, Step(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("Code at %d = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	now := time.Unix(1111111109, 0)
+	step := Step(now)
+	tests := []struct {
+		name   string
+		code   string
+		after  int64
+		want   int64
+		wantOK bool
+	}{
+		{"current step", "081804", 0, step, true},
+		{"previous step within skew", Code(rfcSecret, step-1), 0, step - 1, true},
+		{"next step within skew", Code(rfcSecret, step+1), 0, step + 1, true},
+		{"outside skew", Code(rfcSecret, step-2), 0, 0, false},
+		{"replayed step", "081804", step, 0, false},
+		{"later step after replay", Code(rfcSecret, step+1), step, step + 1, true},
+		{"wrong code", "000000", 0, 0, false},
+		{"too short", "81804", 0, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := Validate(rfcSecret, tt.code, now, tt.after)
+		if got != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: Validate(%q) = %d, %v, want %d, %v", tt.name, tt.code, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package usertokens
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	VerifyEmail   = "verify_email"
+	ChangeEmail   = "change_email"
+	ResetPassword = "reset_password"
+)
+
+var lifetimes = map[string]time.Duration{
+	VerifyEmail:   48 * time.Hour,
+	ChangeEmail:   24 * time.Hour,
+	ResetPassword: time.Hour,
+}
+
+var ErrInvalidToken = errors.New("invalid or expired token")
+
+type Token struct {
+	UserID   int
+	Purpose  string
+	NewEmail *string
+}
+
+// Issuer hands out single-use tokens that are sent to the user by email. Only
+// an HMAC of each token is stored, so a database leak does not expose
+// working links.
+type Issuer struct {
+	key []byte
+}
+
+func NewIssuer(key []byte) *Issuer {
+	return &Issuer{key: key}
+}
+
+func (i *Issuer) hash(token string) string {
+	mac := hmac.New(sha256.New, i.key)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Issue creates a token for purpose and invalidates any earlier unused token
+// the user has for the same purpose.
+func (i *Issuer) Issue(tx *sql.Tx, userID int, purpose string, newEmail *string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if _, err := tx.Exec(`
+		UPDATE user_tokens SET used_at = now()
+		WHERE user_id = $1 AND purpose = $2 AND used_at IS NULL
+	`, userID, purpose); err != nil {
+		return "", err
+	}
+	_, err := tx.Exec(`
+		INSERT INTO user_tokens (token_hash, user_id, purpose, new_email, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, i.hash(token), userID, purpose, newEmail, time.Now().Add(lifetimes[purpose]))
+	return token, err
+}
+
+// IssuedSince reports whether a token for purpose was issued to the user
+// after since, used or not.
+func (i *Issuer) IssuedSince(tx *sql.Tx, userID int, purpose string, since time.Time) (bool, error) {
+	var issued bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (
+			SELECT 1 FROM user_tokens
+			WHERE user_id = $1 AND purpose = $2 AND created_at > $3
+		)
+	`, userID, purpose, since).Scan(&issued)
+	return issued, err
+}
+
+// Consume marks the token as used and returns what it was issued for. Tokens
+// that are unknown, expired, already used or issued for another purpose are
+// all reported as ErrInvalidToken.
+func (i *Issuer) Consume(tx *sql.Tx, token string, purposes ...string) (Token, error) {
+	var t Token
+	err := tx.QueryRow(`
+		UPDATE user_tokens SET used_at = now()
+		WHERE token_hash = $1 AND purpose = ANY($2)
+		  AND used_at IS NULL AND expires_at > now()
+		RETURNING user_id, purpose, new_email
+	`, i.hash(token), pq.Array(purposes)).Scan(&t.UserID, &t.Purpose, &t.NewEmail)
+	if err == sql.ErrNoRows {
+		return Token{}, ErrInvalidToken
+	}
+	return t, err
+}
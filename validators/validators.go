@@ -2,8 +2,13 @@ package validators
 
 import (
 	"fmt"
+	"math"
+	"net/url"
 	"regexp"
 	"server/models"
+	"strconv"
+	"strings"
+	"time"
 	"unicode/utf8"
 )
 
@@ -11,9 +16,24 @@ var (
 	emailRegex = regexp.MustCompile(`^[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}$`)
 	nameRegex  = regexp.MustCompile(`^\p{L}+$`)
 	phoneRegex = regexp.MustCompile(`^\d{11}$`)
-	cardNumRe  = regexp.MustCompile(`^\d{4} \d{4} \d{4} \d{4}$`)
+	cardNumRe  = regexp.MustCompile(`^\d{13,19}$`)
 )
 
+type cardBrand struct {
+	name    string
+	low     int
+	high    int
+	lengths []int
+}
+
+var cardBrands = []cardBrand{
+	{"Мир", 2200, 2204, []int{16, 17, 18, 19}},
+	{"Mastercard", 2221, 2720, []int{16}},
+	{"Mastercard", 5100, 5599, []int{16}},
+	{"Visa", 4000, 4999, []int{13, 16, 19}},
+	{"UnionPay", 6200, 6299, []int{16, 17, 18, 19}},
+}
+
 func ValidateString(field, val string, minLen, maxLen int) error {
 	length := utf8.RuneCountInString(val)
 	if length < minLen || length > maxLen {
@@ -44,11 +64,29 @@ func ValidatePhone(phone string) error {
 }
 
 func ValidateCard(req *models.PaymentCard) error {
-	if !cardNumRe.MatchString(req.CardNumber) {
-		return fmt.Errorf("card_number must be '0000 0000 0000 0000'")
+	number := strings.ReplaceAll(req.CardNumber, " ", "")
+	if !cardNumRe.MatchString(number) {
+		return fmt.Errorf("card_number must contain 13 to 19 digits")
+	}
+	if !luhnValid(number) {
+		return fmt.Errorf("card_number is invalid")
 	}
-	if utf8.RuneCountInString(req.CardholderName) < 1 {
-		return fmt.Errorf("cardholder_name cannot be empty")
+	brand, ok := detectBrand(number)
+	if !ok {
+		return fmt.Errorf("card brand is not supported")
+	}
+	if err := ValidateCardDetails(req); err != nil {
+		return err
+	}
+	req.CardNumber = number
+	req.Brand = brand
+	return nil
+}
+
+func ValidateCardDetails(req *models.PaymentCard) error {
+	name := strings.TrimSpace(req.CardholderName)
+	if n := utf8.RuneCountInString(name); n < 1 || n > 100 {
+		return fmt.Errorf("cardholder_name must be 1 to 100 characters")
 	}
 	if req.ExpMonth < 1 || req.ExpMonth > 12 {
 		return fmt.Errorf("exp_month must be between 1 and 12")
@@ -56,5 +94,93 @@ func ValidateCard(req *models.PaymentCard) error {
 	if req.ExpYear < 0 || req.ExpYear > 99 {
 		return fmt.Errorf("exp_year must be two digits")
 	}
+	now := time.Now()
+	if year := 2000 + req.ExpYear; year < now.Year() || (year == now.Year() && req.ExpMonth < int(now.Month())) {
+		return fmt.Errorf("card has expired")
+	}
+	req.CardholderName = name
+	return nil
+}
+
+func luhnValid(number string) bool {
+	sum := 0
+	double := false
+	for i := len(number) - 1; i >= 0; i-- {
+		d := int(number[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+func detectBrand(number string) (string, bool) {
+	if len(number) < 4 {
+		return "", false
+	}
+	bin, _ := strconv.Atoi(number[:4])
+	for _, b := range cardBrands {
+		if bin < b.low || bin > b.high {
+			continue
+		}
+		for _, l := range b.lengths {
+			if len(number) == l {
+				return b.name, true
+			}
+		}
+		return "", false
+	}
+	return "", false
+}
+
+func CardBrand(number string) string {
+	brand, _ := detectBrand(strings.ReplaceAll(number, " ", ""))
+	return brand
+}
+
+func ValidateProduct(req *models.ProductRequest) error {
+	if err := ValidateString("name", req.Name, 1, 150); err != nil {
+		return err
+	}
+	if req.Price <= 0 || req.Price >= 1e8 || math.Abs(req.Price*100-math.Round(req.Price*100)) > 1e-6 {
+		return fmt.Errorf("price must be positive with at most 2 decimal places")
+	}
+	if err := ValidateString("color", req.Color, 1, 50); err != nil {
+		return err
+	}
+	if req.WidthCm <= 0 || req.HeightCm <= 0 || req.WeightG <= 0 {
+		return fmt.Errorf("width_cm, height_cm and weight_g must be positive")
+	}
+	if req.QuantityInStock < 0 {
+		return fmt.Errorf("quantity_in_stock cannot be negative")
+	}
+	if req.ImageURL != nil {
+		u, err := url.ParseRequestURI(*req.ImageURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("image_url must be an http(s) URL")
+		}
+	}
+	seen := make(map[int]bool, len(req.CategoryIDs))
+	for _, id := range req.CategoryIDs {
+		if id <= 0 || seen[id] {
+			return fmt.Errorf("category_ids must be unique positive ids")
+		}
+		seen[id] = true
+	}
+	return nil
+}
+
+func ValidateCategory(req *models.CategoryRequest) error {
+	if err := ValidateString("name", req.Name, 1, 100); err != nil {
+		return err
+	}
+	if req.ParentID != nil && *req.ParentID <= 0 {
+		return fmt.Errorf("parent_id must be a positive id")
+	}
 	return nil
 }
@@ -0,0 +1,60 @@
+package validators
+
+import "testing"
+
+func TestLuhnValid(t *testing.T) {
+	tests := []struct {
+		number string
+		want   bool
+	}{
+		{"4242424242424242", true},
+		{"4242424242424241", false},
+		{"79927398713", true},
+		{"79927398710", false},
+		{"4222222222222", true},       // 13 digits
+		{"4000000000000000006", true}, // 19 digits
+		{"2221000000000009", true},
+		{"2200000000000004", true},
+		{"6200000000000005", true},
+		{"5555555555554444", true},
+		{"5555555555554440", false},
+	}
+	for _, tt := range tests {
+		if got := luhnValid(tt.number); got != tt.want {
+			t.Errorf("luhnValid(%q) = %v, want %v", tt.number, got, tt.want)
+		}
+	}
+}
+
+func TestDetectBrand(t *testing.T) {
+	tests := []struct {
+		number string
+		brand  string
+		ok     bool
+	}{
+		{"4242424242424242", "Visa", true},
+		{"4222222222222", "Visa", true},
+		{"4000000000000000006", "Visa", true},
+		{"42424242424242", "", false}, // 14 digits
+		{"2220999999999999", "", false},
+		{"2221000000000009", "Mastercard", true},
+		{"2720999999999999", "Mastercard", true},
+		{"2721000000000000", "", false},
+		{"22210000000000000", "", false}, // Mastercard is 16 digits only
+		{"5100000000000000", "Mastercard", true},
+		{"5599999999999999", "Mastercard", true},
+		{"5600000000000000", "", false},
+		{"2200000000000004", "Мир", true},
+		{"2204000000000000000", "Мир", true},
+		{"2205000000000000", "", false},
+		{"6200000000000005", "UnionPay", true},
+		{"6299000000000000000", "UnionPay", true},
+		{"123", "", false},
+	}
+	for _, tt := range tests {
+		brand, ok := detectBrand(tt.number)
+		if brand != tt.brand || ok != tt.ok {
+			t.Errorf("detectBrand(%q) = %q, %v, want %q, %v", tt.number, brand, ok, tt.brand, tt.ok)
+		}
+	}
+}
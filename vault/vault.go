@@ -0,0 +1,84 @@
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrUnknownKey = errors.New("vault: unknown key version")
+
+type Keyring struct {
+	active int
+	keys   map[int]cipher.AEAD
+}
+
+// NewKeyring parses keys in the form "1:<base64 key>,2:<base64 key>", where
+// each key is 32 bytes (AES-256). New data is always sealed with active.
+func NewKeyring(spec string, active int) (*Keyring, error) {
+	k := &Keyring{active: active, keys: make(map[int]cipher.AEAD)}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		ver, b64, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, fmt.Errorf("vault: key %q must be <version>:<base64>", part)
+		}
+		v, err := strconv.Atoi(ver)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("vault: bad key version %q", ver)
+		}
+		raw, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("vault: key %d: %v", v, err)
+		}
+		if len(raw) != 32 {
+			return nil, fmt.Errorf("vault: key %d must be 32 bytes, got %d", v, len(raw))
+		}
+		block, err := aes.NewCipher(raw)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[v] = aead
+	}
+	if _, ok := k.keys[active]; !ok {
+		return nil, fmt.Errorf("vault: active key version %d is not configured", active)
+	}
+	return k, nil
+}
+
+func (k *Keyring) Active() int {
+	return k.active
+}
+
+func (k *Keyring) Encrypt(plaintext, aad []byte) ([]byte, int, error) {
+	aead := k.keys[k.active]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, 0, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), k.active, nil
+}
+
+func (k *Keyring) Decrypt(ciphertext []byte, version int, aad []byte) ([]byte, error) {
+	aead, ok := k.keys[version]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("vault: ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, aad)
+}